@@ -0,0 +1,51 @@
+package chat
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeManager returns a manager obtaining certificates for hosts from Let's
+// Encrypt, and renewing them before they expire. The account key and
+// certificates are kept in dir, which is created now so that a bad dir fails
+// at startup rather than at the first handshake. The sandbox is not confined
+// to dir: it allows reading and writing files anywhere, as for snapshots.
+func acmeManager(hosts []string, dir string) (*autocert.Manager, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(dir),
+	}, nil
+}
+
+// acmeTLSConfig returns the settings of the TLS listeners with certificates
+// from m, also answering TLS-ALPN-01 challenges.
+func acmeTLSConfig(m *autocert.Manager) *tls.Config {
+	config := tlsConfig(m.GetCertificate)
+	config.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	return config
+}
+
+// httpsRedirect redirects requests to the same URL over HTTPS on port.
+func httpsRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(),
+			http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,269 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxBannerLen is the longest site-wide banner, in runes.
+const maxBannerLen = 200
+
+// banner is the escaped site-wide notice shown above every room and the room
+// list, if not empty.
+var banner string
+
+// bannerSet is when the banner last changed, for Last-Modified.
+var bannerSet time.Time
+
+// adminToken authorizes /admin requests as "Authorization: Bearer <token>".
+// Admin endpoints are disabled while it is empty.
+var adminToken string
+
+func isAdmin(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]),
+		[]byte(adminToken)) == 1
+}
+
+// admin serves /admin/op.
+func admin(op string, w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	setCSP(w, "default-src 'none';")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	method := "POST"
+	if op == "hooks" || op == "pending" || op == "state" {
+		method = "GET"
+	}
+
+	if r.Method != method {
+		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "form invalid", http.StatusBadRequest)
+		return
+	}
+
+	switch op {
+	case "approve":
+		adminModerate(true, w, r)
+	case "banner":
+		adminBanner(w, r)
+	case "hooks":
+		adminHooks(w, r)
+	case "merge":
+		adminMerge(w, r)
+	case "import":
+		adminImport(w, r)
+	case "newhook":
+		adminNewHook(w, r)
+	case "pending":
+		adminPending(w, r)
+	case "premod":
+		adminPremod(w, r)
+	case "prune":
+		adminPrune(w, r)
+	case "purge":
+		adminPurge(w, r)
+	case "reject":
+		adminModerate(false, w, r)
+	case "revokehook":
+		adminRevokeHook(w, r)
+	case "state":
+		adminState(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// adminMerge merges the history of room "from" into room "to", interleaved
+// by time, and redirects the old name.
+func adminMerge(w http.ResponseWriter, r *http.Request) {
+	from, to := r.PostFormValue("from"), r.PostFormValue("to")
+
+	if _, ok := rooms[from]; !ok {
+		http.Error(w, "no such room: "+from, http.StatusNotFound)
+		return
+	}
+	if _, ok := rooms[to]; !ok || from == to {
+		http.Error(w, "no such room: "+to, http.StatusNotFound)
+		return
+	}
+
+	if err := mutate(raftEntry{
+		Op:   "merge",
+		Room: from,
+		To:   to,
+		Time: time.Now().UTC(),
+	}); err != nil {
+		http.Error(w, err.Error(), postStatus(err))
+		return
+	}
+
+	fmt.Fprintf(w, "merged %s into %s\n", from, to)
+}
+
+// mergeRooms merges room from into room to as of now. The global lock must be
+// held for writing.
+func mergeRooms(from, to string, now time.Time) error {
+	waitRooms(from, to)
+
+	src, ok := rooms[from]
+	if !ok {
+		return errNoSuchRoom
+	}
+
+	dst, ok := rooms[to]
+	if !ok || from == to {
+		return errNoSuchRoom
+	}
+
+	msgs := dst.msgs.slice()
+	seen := make(map[string]bool, len(msgs))
+	for _, m := range msgs {
+		seen[m.s] = true
+	}
+
+	for i := src.msgs.Len() - 1; i >= 0; i-- {
+		m := src.msgs.At(i)
+		if seen[m.s] {
+			continue
+		}
+		seen[m.s] = true
+		msgs = append(msgs, m)
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].at.After(msgs[j].at)
+	})
+	if len(msgs) > maxMsgsCount {
+		msgs = msgs[:maxMsgsCount]
+	}
+
+	// The history of "to" changed, so every msg is numbered anew in the
+	// order they were posted. A seq is skipped first, so no client's
+	// since reaches back far enough for a delta and all reload in full.
+	dst.seq++
+	for i := len(msgs) - 1; i >= 0; i-- {
+		dst.seq++
+		msgs[i].seq = dst.seq
+	}
+	dst.msgs = ringOf(msgs)
+
+	if src.last.After(dst.last) {
+		dst.last = src.last
+	}
+
+	dst.stats.merge(src.stats)
+
+	delete(rooms, from)
+
+	pruneStore([]string{from})
+	saveRoom(to)
+
+	redirects[from] = redirect{
+		to:      to,
+		expires: now.Add(lifespan),
+	}
+
+	// Sessions following the old name pick up the redirect.
+	emit(roomsChanged{rooms: []string{from, to}})
+
+	return nil
+}
+
+// adminPrune deletes rooms with no msgs for the duration "older-than", like
+// rooms outliving their lifespan.
+func adminPrune(w http.ResponseWriter, r *http.Request) {
+	d, err := time.ParseDuration(r.PostFormValue("older-than"))
+	if err != nil || d < 0 {
+		http.Error(w, "bad older-than", http.StatusBadRequest)
+		return
+	}
+
+	if raftNode == nil {
+		fmt.Fprintf(w, "pruned %d rooms\n", len(expire(d)))
+		return
+	}
+
+	names := expired(d)
+	if err := mutate(raftEntry{
+		Op:    "prune",
+		Time:  time.Now().UTC(),
+		Age:   d,
+		Names: names,
+	}); err != nil {
+		http.Error(w, err.Error(), postStatus(err))
+		return
+	}
+
+	fmt.Fprintf(w, "pruned %d rooms\n", len(names))
+}
+
+// adminBanner sets the site-wide banner to msg, or clears it if msg is empty.
+func adminBanner(w http.ResponseWriter, r *http.Request) {
+	str := strings.TrimSpace(norm.NFC.String(r.PostFormValue("msg")))
+
+	if str == "" {
+		banner, bannerSet = "", time.Now().UTC()
+		fmt.Fprintln(w, "banner cleared")
+		return
+	}
+
+	if utf8.RuneCountInString(str) > maxBannerLen {
+		http.Error(w, errMsgTooLong.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !utf8.ValidString(str) || !validMsg.MatchString(str) {
+		http.Error(w, errBadMsg.Error(), http.StatusBadRequest)
+		return
+	}
+
+	banner, bannerSet = html.EscapeString(str), time.Now().UTC()
+
+	// Rooms redraw on their next poll; wake anyone waiting instead.
+	names := make([]string, 0, len(rooms))
+	for name := range rooms {
+		names = append(names, name)
+	}
+	emit(roomsChanged{rooms: names})
+
+	fmt.Fprintln(w, "banner set")
+}
+
+func printBanner(w io.Writer) {
+	if banner != "" {
+		printNotice(w, banner)
+	}
+}
+
+// printNotice writes the escaped str as a notice above the chat.
+func printNotice(w io.Writer, str string) {
+	io.WriteString(w, "<p><strong>notice: <bdi>")
+	io.WriteString(w, str)
+	io.WriteString(w, "</bdi></strong></p>")
+}
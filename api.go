@@ -0,0 +1,297 @@
+package chat
+
+import (
+	"encoding/json"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxAPIBody bounds JSON request bodies.
+const maxAPIBody = 4096
+
+type apiRoom struct {
+	Name string    `json:"name"`
+	Last time.Time `json:"last"`
+	Seq  uint64    `json:"seq"`
+}
+
+type apiMsg struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// apiPost is the body of POST /api/v1/rooms/{name}/messages. In optionally
+// delays the msg, e.g. "90m".
+type apiPost struct {
+	Msg string `json:"msg"`
+	In  string `json:"in,omitempty"`
+}
+
+func apiJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, code int, msg string) {
+	apiJSON(w, code, map[string]string{"error": msg})
+}
+
+// apiRoute is an endpoint of the API. The OpenAPI description is generated
+// from these, so they document what is actually served.
+type apiRoute struct {
+	method  string
+	path    string // relative to /api/v1, {name} is the room
+	summary string
+	query   []string    // optional query parameters
+	body    interface{} // request body, if any
+	code    int         // status on success
+	resp    interface{} // response body on success
+
+	handle func(name string, w http.ResponseWriter, r *http.Request)
+}
+
+var apiRoutes = []apiRoute{{
+	method:  "GET",
+	path:    "/rooms",
+	summary: "List rooms",
+	code:    http.StatusOK,
+	resp:    []apiRoom{},
+	handle: func(_ string, w http.ResponseWriter, _ *http.Request) {
+		apiRooms(w)
+	},
+}, {
+	method: "GET",
+	path:   "/rooms/{name}/messages",
+	summary: "List msgs oldest first, optionally after or before a " +
+		"sequence number or RFC 3339 time",
+	query:  []string{"after", "before"},
+	code:   http.StatusOK,
+	resp:   []apiMsg{},
+	handle: apiMsgs,
+}, {
+	method: "POST",
+	path:   "/rooms/{name}/messages",
+	summary: "Post a msg, creating the room if needed; 202 if it is " +
+		"scheduled or held for moderation",
+	body:   apiPost{},
+	code:   http.StatusCreated,
+	resp:   map[string]uint64{},
+	handle: apiPostMsg,
+}}
+
+// route finds the route for method and path, returning the room name if the
+// path has one, or the status to reply with if there is no route.
+func route(method, path string) (*apiRoute, string, int) {
+	parts := strings.Split(path, "/")
+	code := http.StatusNotFound
+
+	for i := range apiRoutes {
+		rt := &apiRoutes[i]
+
+		want := strings.Split(rt.path, "/")
+		if len(want) != len(parts) {
+			continue
+		}
+
+		var name string
+		match := true
+		for j := range want {
+			if want[j] == "{name}" {
+				name = parts[j]
+			} else if want[j] != parts[j] {
+				match = false
+				break
+			}
+		}
+
+		if !match {
+			continue
+		} else if rt.method != method {
+			code = http.StatusMethodNotAllowed
+			continue
+		}
+
+		return rt, name, 0
+	}
+
+	return nil, "", code
+}
+
+// api serves the JSON API under /api/v1/, with the same validation and
+// limits as the pages.
+func api(w http.ResponseWriter, r *http.Request) {
+	securityHeaders(w)
+	setCSP(w, "default-src 'none';")
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1")
+	if path == "/openapi.json" && r.Method == "GET" {
+		if limit(readLimit, w, r) {
+			apiJSON(w, http.StatusOK, openAPI())
+		}
+		return
+	}
+
+	rt, name, code := route(r.Method, path)
+	switch code {
+	case http.StatusNotFound:
+		apiError(w, code, "not found")
+		return
+	case http.StatusMethodNotAllowed:
+		apiError(w, code, "bad http verb")
+		return
+	}
+
+	if strings.Contains(rt.path, "{name}") && (name == "" ||
+		len(name) > maxNameLen || !validName.MatchString(name)) {
+		apiError(w, http.StatusBadRequest, "bad name")
+		return
+	}
+
+	if r.Method != "POST" && !limit(readLimit, w, r) {
+		return
+	}
+
+	if r.Method == "POST" && listed(clientAddr(r)) &&
+		!limit(listedLimit, w, r) {
+		return
+	}
+
+	// Posting takes the locks it needs itself, and reads share the lock.
+	if r.Method == "POST" {
+		rt.handle(name, w, r)
+		return
+	}
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	rt.handle(name, w, r)
+}
+
+// apiRooms lists the rooms. The global lock must be held, at least for
+// reading.
+func apiRooms(w http.ResponseWriter) {
+	list := make([]apiRoom, 0, len(rooms))
+	for name, rm := range rooms {
+		rm.mu.Lock()
+		list = append(list, apiRoom{
+			Name: name,
+			Last: rm.last,
+			Seq:  rm.seq,
+		})
+		rm.mu.Unlock()
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	apiJSON(w, http.StatusOK, list)
+}
+
+// apiMsgs lists msgs oldest first, filtered by ?after= and ?before=.
+func apiMsgs(name string, w http.ResponseWriter, r *http.Request) {
+	mr, err := parseRange(r.URL.Query())
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name, _ = resolve(name)
+	rm, ok := rooms[name]
+	if !ok {
+		apiError(w, http.StatusNotFound, "no such room")
+		return
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	apiJSON(w, http.StatusOK, apiMsgList(rm, mr))
+}
+
+// apiMsgList returns the msgs of rm within mr, oldest first.
+func apiMsgList(rm *room, mr msgRange) []apiMsg {
+	list := make([]apiMsg, 0, rm.msgs.Len())
+	for i := rm.msgs.Len() - 1; i >= 0; i-- {
+		if m := rm.msgs.At(i); mr.has(m) {
+			list = append(list, apiMsg{
+				Seq:  m.seq,
+				Time: m.at,
+				Text: html.UnescapeString(m.s),
+			})
+		}
+	}
+	return list
+}
+
+// wantsJSON reports whether the client accepts application/json, so pages
+// can answer with the same JSON as the API.
+func wantsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, _, err := mime.ParseMediaType(part)
+		if err == nil && t == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// apiPostMsg posts a msg. The global lock must not be held, as posting takes
+// what it needs.
+func apiPostMsg(name string, w http.ResponseWriter, r *http.Request) {
+	var p apiPost
+	if err := json.NewDecoder(io.LimitReader(r.Body,
+		maxAPIBody)).Decode(&p); err != nil {
+		apiError(w, http.StatusBadRequest, "body invalid")
+		return
+	}
+
+	lock.RLock()
+	name, _ = resolve(name)
+	_, exists := rooms[name]
+	lock.RUnlock()
+
+	if geoBlocked(clientAddr(r), !exists) {
+		apiError(w, http.StatusForbidden, errGeoBlocked.Error())
+		return
+	}
+
+	id := clientID(clientAddr(r))
+
+	var seq uint64
+	var err error
+	if p.In != "" {
+		d, perr := time.ParseDuration(p.In)
+		if perr != nil {
+			apiError(w, http.StatusBadRequest, errBadDelay.Error())
+			return
+		}
+		err = scheduleMsg(name, p.Msg, id, d)
+	} else {
+		seq, err = addMsg(name, p.Msg, id)
+	}
+
+	switch {
+	case err == errHeld:
+		apiJSON(w, http.StatusAccepted, map[string]string{
+			"status": "held",
+		})
+	case err != nil:
+		apiError(w, postStatus(err), err.Error())
+	case p.In != "":
+		apiJSON(w, http.StatusAccepted, map[string]string{
+			"status": "scheduled",
+		})
+	default:
+		apiJSON(w, http.StatusCreated, map[string]uint64{
+			"seq": seq,
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveTime names archived transcripts after when they were archived.
+const archiveTime = "20060102T150405Z"
+
+const archivePageStart = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport"
+		content="width=device-width, initial-scale=1, shrink-to-fit=no">
+	<title>Archive: %s</title>
+</head>
+<body>
+	<p>archive: %s</p>
+	<p><a href="%s">&lt; back</a></p>`
+
+const archivePageEnd = `
+</body>
+</html>`
+
+// archiveDir, if set, is where rooms are archived before they are pruned,
+// as archiveDir/room/archiveTime.json.
+var archiveDir string
+
+// archiveRoom writes the msgs of rm, in the form of /admin/state, to the
+// archive directory and bucket. Empty rooms are not archived.
+func archiveRoom(name string, rm *room) error {
+	if archiveDir == "" && archiveS3 == nil || rm.msgs.Len() == 0 {
+		return nil
+	}
+
+	rs := stateOf(rm)
+	rs.Creator = nil
+
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+
+	file := time.Now().UTC().Format(archiveTime) + ".json"
+
+	if archiveS3 != nil {
+		archiveS3.upload(name+"/"+file, b)
+	}
+
+	if archiveDir == "" {
+		return nil
+	}
+
+	dir := filepath.Join(archiveDir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, file)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// archive serves the archive read-only: /archive/ lists archived rooms,
+// /archive/name lists the times a room was archived, and /archive/name/time
+// shows the transcript archived then.
+func archive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+		return
+	}
+
+	securityHeaders(w)
+
+	if !limit(readLimit, w, r) {
+		return
+	}
+
+	setCSP(w, "default-src 'none';")
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path,
+		"/archive/"), "/"), "/")
+
+	switch {
+	case parts[0] == "" && len(parts) == 1:
+		archiveRooms(w, r)
+	case len(parts[0]) > maxNameLen || !validName.MatchString(parts[0]):
+		http.Error(w, "bad name", http.StatusBadRequest)
+	case len(parts) == 1:
+		archiveTimes(parts[0], w, r)
+	case len(parts) == 2:
+		archiveTranscript(parts[0], parts[1], w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func archiveRooms(w http.ResponseWriter, r *http.Request) {
+	infos, err := ioutil.ReadDir(archiveDir)
+	if err != nil {
+		http.Error(w, "archive unavailable",
+			http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, archivePageStart, "rooms", "expired rooms", prefix+"/")
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() && validName.MatchString(name) {
+			fmt.Fprintf(w, `
+	<p><a href="%s/archive/%s">%s &gt;</a></p>`, prefix, name, name)
+		}
+	}
+	fmt.Fprint(w, archivePageEnd)
+}
+
+func archiveTimes(name string, w http.ResponseWriter, r *http.Request) {
+	infos, err := ioutil.ReadDir(filepath.Join(archiveDir, name))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "archive unavailable",
+			http.StatusInternalServerError)
+		return
+	}
+
+	// Newest first, like rooms.
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() > infos[j].Name()
+	})
+
+	fmt.Fprintf(w, archivePageStart, name, name, prefix+"/archive/")
+	for _, fi := range infos {
+		t, err := time.Parse(archiveTime,
+			strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, `
+	<p><a href="%s/archive/%s/%s">archived %s &gt;</a></p>`, prefix, name,
+			t.Format(archiveTime), t.Format("2006-01-02 15:04"))
+	}
+	fmt.Fprint(w, archivePageEnd)
+}
+
+func archiveTranscript(name, at string, w http.ResponseWriter,
+	r *http.Request) {
+	t, err := time.Parse(archiveTime, at)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(archiveDir, name,
+		t.Format(archiveTime)+".json"))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "archive unavailable",
+			http.StatusInternalServerError)
+		return
+	}
+
+	var rs roomState
+	if err := json.Unmarshal(b, &rs); err != nil {
+		http.Error(w, "archive unavailable",
+			http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, archivePageStart, name, name, prefix+"/archive/"+name)
+	fmt.Fprintf(w, `
+	<p>archived %s, read-only (time in UTC):</p><pre>`,
+		t.Format("2006-01-02 15:04"))
+	for _, m := range rs.Msgs {
+		printMsg(w, msg{s: m.S, t: m.At.Format("2006-01-02 15:04")})
+	}
+	fmt.Fprint(w, "</pre>"+archivePageEnd)
+}
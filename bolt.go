@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// roomsBucket holds a key per room, named after it, whose value is the
+// room's msgs as a JSON list, newest first.
+var roomsBucket = []byte("rooms")
+
+// boltStore keeps rooms in a bbolt file, for single-instance servers that
+// want rooms to survive restarts without a database server or cgo.
+//
+// Keeping a room's msgs in one value makes pruning a single delete and
+// restoring a single read, but each append rewrites the room's list. Lists
+// are capped at maxMsgsCount like rooms are, so that is at most a few
+// kilobytes. Every change is a transaction synced to disk before the post
+// returns, which bounds msg throughput by the disk's fsync latency; bbolt
+// also allows only one writer at a time, so posts to different rooms, which
+// are stored with no lock held, queue for it. The file only grows; space
+// freed by pruned rooms is reused, not returned.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(roomsBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltStore) CreateRoom(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(roomsBucket)
+		if b.Get([]byte(name)) != nil {
+			return nil
+		}
+		return b.Put([]byte(name), []byte("[]"))
+	})
+}
+
+func (s *boltStore) AppendMessage(name string, m Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(roomsBucket)
+
+		msgs, err := boltMsgs(b, name)
+		if err != nil {
+			return err
+		}
+
+		msgs = append([]Message{m}, msgs...)
+		if len(msgs) > maxMsgsCount {
+			msgs = msgs[:maxMsgsCount]
+		}
+
+		v, err := json.Marshal(msgs)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), v)
+	})
+}
+
+func (s *boltStore) Messages(name string) ([]Message, error) {
+	var msgs []Message
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		msgs, err = boltMsgs(tx.Bucket(roomsBucket), name)
+		return err
+	})
+	return msgs, err
+}
+
+func (s *boltStore) Prune(names []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(roomsBucket)
+		for _, name := range names {
+			if err := b.Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) ListRooms() ([]string, error) {
+	var names []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(roomsBucket).ForEach(func(k, _ []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// boltMsgs decodes the msgs of the room, which are only valid for the life
+// of the transaction b belongs to.
+func boltMsgs(b *bolt.Bucket, name string) ([]Message, error) {
+	v := b.Get([]byte(name))
+	if v == nil {
+		return nil, nil
+	}
+
+	var msgs []Message
+	if err := json.Unmarshal(v, &msgs); err != nil {
+		return nil, fmt.Errorf("bolt: room %s: %w", name, err)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,143 @@
+package chat
+
+import "sync"
+
+// event is something that happened to a room, emitted on the bus to every
+// listener: a msgPosted, roomCreated, roomsPruned or roomsChanged.
+type event interface {
+	isEvent()
+}
+
+// msgPosted is emitted for each msg added to a room on this instance, once
+// it is stored. id is the poster's client ID, and from the session or bridge
+// it was posted from, as given to addMsgFrom.
+type msgPosted struct {
+	room string
+	id   string
+	from string
+	msg  Message
+}
+
+// roomCreated is emitted for each room created.
+type roomCreated struct {
+	room string
+}
+
+// roomsPruned is emitted for rooms deleted, by expiry or, if purged is set,
+// by an admin. rms are the rooms as they were when deleted, in the order of
+// their names in rooms.
+type roomsPruned struct {
+	rooms  []string
+	rms    []*room
+	purged bool
+}
+
+// roomsChanged is emitted for rooms changed other than by a msg posted on
+// this instance: by msgs from other instances, renames and merges, which
+// move sessions to the new name, restores, and the banner.
+type roomsChanged struct {
+	rooms []string
+}
+
+func (msgPosted) isEvent()    {}
+func (roomCreated) isEvent()  {}
+func (roomsPruned) isEvent()  {}
+func (roomsChanged) isEvent() {}
+
+// listeners are called, in order, with each event. They are added from init
+// functions.
+var listeners []func(event)
+
+// listen adds f to the listeners.
+func listen(f func(event)) {
+	listeners = append(listeners, f)
+}
+
+// emit sends e to every listener. The global lock must be held, if only for
+// reading along with the mu of the room posted to, so listeners must be
+// quick, must not block, and must not take the global lock.
+func emit(e event) {
+	for _, f := range listeners {
+		f(e)
+	}
+}
+
+// watcher follows a room for a session, such as a stream or a bridge. c
+// receives whenever the room may have changed since, and the session then
+// reads it again under the global lock, so no change is missed as long as
+// the watcher is made before the room is first read.
+type watcher struct {
+	room string
+	c    chan struct{}
+}
+
+var (
+	// watchers are the watchers of each room, by name, guarded by
+	// watchMu, which unlike the global lock listeners may take.
+	watchers = make(map[string]map[*watcher]bool)
+	watchMu  sync.Mutex
+)
+
+func init() {
+	listen(func(e event) {
+		switch e := e.(type) {
+		case msgPosted:
+			wake(e.room)
+		case roomCreated:
+			wake(e.room)
+		case roomsPruned:
+			wake(e.rooms...)
+		case roomsChanged:
+			wake(e.rooms...)
+		}
+	})
+}
+
+// watch returns a watcher of the room, which must be stopped once done.
+func watch(name string) *watcher {
+	w := &watcher{c: make(chan struct{}, 1)}
+	w.follow(name)
+	return w
+}
+
+// follow moves the watcher to the room, e.g. the new name of one renamed.
+func (w *watcher) follow(name string) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	w.remove()
+	w.room = name
+	if watchers[name] == nil {
+		watchers[name] = make(map[*watcher]bool)
+	}
+	watchers[name][w] = true
+}
+
+func (w *watcher) stop() {
+	watchMu.Lock()
+	w.remove()
+	watchMu.Unlock()
+}
+
+// remove drops the watcher from its room. watchMu must be held.
+func (w *watcher) remove() {
+	delete(watchers[w.room], w)
+	if len(watchers[w.room]) == 0 {
+		delete(watchers, w.room)
+	}
+}
+
+// wake tells the watchers of the rooms they changed. It never blocks.
+func wake(names ...string) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	for _, name := range names {
+		for w := range watchers[name] {
+			select {
+			case w.c <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
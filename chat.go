@@ -1,36 +1,217 @@
-package main
+// Package chat is a room-based chat server. Run it with cmd/chat, or mount
+// it in another server with New.
+package chat
 
 import (
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
 	"html"
+	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/esote/graceful"
-	"github.com/esote/openshim2"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/grpc"
 )
 
 type msg struct {
-	s string
-	t string
+	s   string
+	t   string
+	at  time.Time
+	seq uint64
+
+	// from is the session or bridge that posted the msg, if it asked,
+	// so it is not sent back there. It is kept only in memory.
+	from string
+}
+
+// String formats m as plain text.
+func (m msg) String() string {
+	return m.t + ": " + html.UnescapeString(m.s)
+}
+
+// fromPeer marks msgs posted on other instances of a cluster.
+const fromPeer = "peer"
+
+// relayed reports whether the bridge from relays m elsewhere: only msgs posted
+// on this instance, not by the bridge itself, and in a Raft cluster only on
+// the leader, so each msg leaves the cluster once.
+func (m msg) relayed(from string) bool {
+	return m.from != from && m.from != fromPeer && !raftFollower()
 }
 
 type room struct {
-	msgs []msg
+	// mu guards the room when the global lock is held only for reading,
+	// as it is while posting. Holding the global lock for writing
+	// excludes everyone else, so mu need not be taken as well.
+	mu sync.Mutex
+
+	msgs msgRing
 	last time.Time
+	seq  uint64
+
+	stats *roomStats
+
+	// premod holds posts in pending until an admin approves them.
+	premod     bool
+	pending    []pending
+	pendingSeq uint64
+
+	// creator is the SHA-256 of the creator token, if the room was
+	// created over HTTP.
+	creator []byte
+
+	// scheduled counts messages waiting to be posted later. Rooms with
+	// scheduled messages are not pruned.
+	scheduled int
+
+	// posting is set while a msg is stored with no lock held. Msgs are
+	// stored one at a time per room, later posts waiting for idle to be
+	// closed, and the room is not pruned, renamed or merged meanwhile.
+	posting bool
+	idle    chan struct{}
 }
 
 var (
-	rooms = make(map[string]room)
-	lock  = sync.Mutex{}
+	// rooms are guarded by lock, which is held only briefly while
+	// posting, and then only for reading, so posts to different rooms do
+	// not wait on each other. lock is always taken before the mu of a
+	// room, never after.
+	rooms = make(map[string]*room)
+	lock  = sync.RWMutex{}
+
+	// roomFree is broadcast whenever a room stops posting.
+	roomFree = sync.NewCond(&lock)
 
 	validName = regexp.MustCompile("^[a-z]*$")
-	validMsg  = regexp.MustCompile(`^[[:print:]]+$`)
+	validMsg  = regexp.MustCompile(`^[\p{L}\p{M}\p{N}\p{P}\p{S} ]+$`)
+
+	// foldName matches names accepted from users, which are folded to
+	// lowercase.
+	foldName = regexp.MustCompile("^[a-zA-Z]*$")
+
+	plainAgents = regexp.MustCompile(`^(curl|Wget|HTTPie|xh)/`)
+
+	readLimit = newLimiter(readRate, readBurst)
+
+	// shutdown is closed when the server begins shutting down, telling
+	// streaming sessions (tracked by streams) to say goodbye and end.
+	shutdown = make(chan struct{})
+	streams  sync.WaitGroup
+
+	// dev skips sandboxing, binds to localhost, logs requests, serves
+	// pprof, and omits HSTS.
+	dev bool
+
+	// outbound is set when a feature connects out (or resolves names)
+	// after startup, which the sandbox must allow.
+	outbound bool
+
+	// rereads is set when files are read again after startup, e.g. TLS
+	// certificates on renewal, which the sandbox must allow.
+	rereads bool
+
+	// writes is set when files are written after startup, e.g. snapshots,
+	// which the sandbox must allow.
+	writes bool
+
+	// flocks is set when a file lock is held, e.g. on the bbolt store,
+	// which the sandbox must allow to be released.
+	flocks bool
+
+	// upgrades starts the binary anew on SIGUSR2, handing over the
+	// sockets, which the sandbox must allow. upgrading is set, with the
+	// global lock held for writing, while the rooms are saved for the new
+	// process, refusing changes to them. upgraded is set, atomically,
+	// once the new process serves in place of this one.
+	upgrades  bool
+	upgrading bool
+	upgraded  uint32
+
+	// nojs serves rooms without realtime.js, for zero-JavaScript
+	// deployments.
+	nojs bool
+
+	// prefix is the path the server is mounted under by New, e.g. /chat,
+	// and empty when it serves the whole host.
+	prefix string
+
+	// gopherAddr enables a read-only gopher listener, and gopherHost is
+	// the hostname used in its menus.
+	gopherAddr string
+	gopherHost string
+
+	// lineAddr enables a telnet-style line-mode listener.
+	lineAddr string
+
+	// ircAddr enables the IRC gateway.
+	ircAddr string
+
+	// nntpAddr enables the read-only NNTP listener.
+	nntpAddr string
+
+	// smtpAddr enables the SMTP gateway for posting by mail.
+	smtpAddr string
+
+	// geminiAddr enables the Gemini listener, which uses the TLS
+	// certificate of the HTTP server.
+	geminiAddr string
+
+	// http3Addr enables HTTP/3 over QUIC on this UDP address, which uses
+	// the TLS certificate of the HTTP server.
+	http3Addr string
+
+	// datagrams is set when a UDP socket is served, e.g. for HTTP/3,
+	// which the sandbox must allow.
+	datagrams bool
+
+	// sshAddr enables an SSH listener using the host key in sshKey. If
+	// sshAuthorizedKeys is set only the keys it lists may connect.
+	sshAddr           string
+	sshKey            string
+	sshAuthorizedKeys string
+
+	// grpcAddr enables the Chat service of chat.proto over gRPC.
+	grpcAddr string
+
+	// reserved names are used by server pages and cannot be rooms.
+	reserved = map[string]bool{
+		"about":   true,
+		"admin":   true,
+		"api":     true,
+		"archive": true,
+		"events":  true,
+		"hooks":   true,
+		"static":  true,
+		"ws":      true,
+	}
+
+	errTooManyRooms = errors.New("too many rooms")
+	errReserved     = errors.New("name reserved")
+	errMsgTooLong   = errors.New("msg too long")
+	errBadMsg       = errors.New("bad msg")
+	errBadDelay     = errors.New("bad delay")
+	errTooScheduled = errors.New("too many scheduled msgs")
+	errUpgrading    = errors.New("server upgrading, try again shortly")
 )
 
 const (
@@ -38,305 +219,2030 @@ const (
 	maxMsgLen    = 80
 	maxMsgsCount = 50
 	maxNameLen   = 5
+	maxScheduled = 10
+
+	// Reads (page loads and polling) per client: a burst of readBurst,
+	// refilling at readRate per second.
+	readRate  = 2
+	readBurst = 10
+
+	// Clients poll every minPoll to maxPoll; busyPolls is the number of
+	// polls per second beyond which intervals are stretched.
+	minPoll   = time.Second
+	maxPoll   = 30 * time.Second
+	busyPolls = 200
+
+	// maxWait bounds how long a long poll (PATCH ?wait=) is held open.
+	maxWait = time.Minute
 
 	lifespan = 24 * time.Hour
 
-	welcomeStart = `<!DOCTYPE html>
-<html lang="en">
-<head>
-	<meta charset="utf-8">
-	<meta name="viewport"
-		content="width=device-width, initial-scale=1, shrink-to-fit=no">
-	<meta name="author" content="Esote">
-	<meta name="description" content="Room-based chat server">
-	<title>Room-based chat server</title>
-</head>
-<body>
-	<p>welcome, join existing rooms:</p>`
-
-	welcomeEnd = `
-	<form action="/" method="get" autocomplete="off">
-		<label>or make a room: </label>
-		<input type="text" name="name" required placeholder="name_here"
-			maxlength="%d" pattern="%s" title="lowercase letters">
-		<input type="submit" value="make room">
-	</form>
-	<p>chat is not moderated, and no connection logs are kept</p>
-	<p>room lifespan: %s (time until lossy room pruning may occur)</p>
-	<p>Author: <a href="https://github.com/esote"
-		target="_blank">Esote</a>.
-
-		<a href="https://github.com/esote/chat"
-		target="_blank">Source code</a>.</p>
-</body>
-</html>`
-
-	roomStart = `<!DOCTYPE html>
-<html lang="en">
-<head>
-	<meta charset="utf-8">
-	<meta name="viewport"
-		content="width=device-width, initial-scale=1, shrink-to-fit=no">
-	<title>Room: %s</title>
-</head>
-<body>
-	<p>room: %s</p>
-	<p><a href="/">&lt; back</a></p>
-	<form action="%s" method="post" autocomplete="off">
-		<input type="text" name="msg" required autofocus maxlength="%d">
-		<input type="submit" value="msg">
-	</form>
-	<p>chat history (time in UTC):</p><div id="chat">`
-
-	roomEnd = `</div>
-	<noscript>
-		<p>without JS manually refresh to page to see new messages</p>
-	</noscript>
-	<script src="/realtime.js" integrity="sha512-+1INo3ZKQFSCijyLvXUVgQI00PLvSRnaqMZzUOqVW2bLzq8u6Bs0NdJci1GSAkLAmMvEdY3rkKNQPzPcn/XUMQ=="></script>
-</body>
-</html>`
-
-	realtimeJS = `"use strict";
-const http = new XMLHttpRequest();
-const chat = document.getElementById("chat");
-const path = window.location.pathname.split("/").pop();
-
-http.onreadystatechange = function() {
-	if (http.readyState == 4 && http.responseText != ""
-		&& http.responseText != chat.innerHTML) {
-		chat.innerHTML = http.responseText;
-	}
-}
-
-function update() {
-	http.open("PATCH", path, true);
-	http.send(null);
-}
-
-setInterval(update, 1000);
-`
+	shutdownNotice = "server restarting, back shortly"
 )
 
+// noticeShutdown reports whether streaming sessions tell their clients of
+// the shutdown, which they do not on upgrade, as the new process serves in
+// place of this one.
+func noticeShutdown() bool {
+	return atomic.LoadUint32(&upgraded) == 0
+}
+
 func pruneRooms() {
-	for k, v := range rooms {
-		if time.Now().UTC().Sub(v.last) > lifespan {
-			delete(rooms, k)
+	if raftNode != nil {
+		raftPrune()
+	} else {
+		expire(lifespan)
+	}
+	pruneRedirects()
+}
+
+// expire deletes rooms with no msgs for longer than d, unless msgs are
+// scheduled for them, archiving them first, and returns their names. Rooms
+// that fail to archive are kept, to try again later.
+func expire(d time.Duration) []string {
+	var pruned []string
+	var rms []*room
+
+	for _, k := range expired(d) {
+		v := rooms[k]
+
+		if err := archiveRoom(k, v); err != nil {
+			log.Printf("archive: %v", err)
+			continue
+		}
+
+		delete(rooms, k)
+		pruned = append(pruned, k)
+		rms = append(rms, v)
+	}
+
+	pruneStore(pruned)
+	emit(roomsPruned{rooms: pruned, rms: rms})
+
+	return pruned
+}
+
+// createRoom creates the room, unless it exists, through the log with Raft.
+// The global lock must be held for writing, and with Raft is released
+// meanwhile; the room exists once createRoom succeeds.
+func createRoom(name string) error {
+	if reserved[name] {
+		return errReserved
+	}
+
+	for {
+		if _, ok := rooms[name]; ok {
+			return nil
+		}
+
+		if err := mutate(raftEntry{
+			Op:   "create",
+			Room: name,
+			Time: time.Now().UTC(),
+		}); err != nil {
+			return err
 		}
 	}
 }
 
-func tryCreateRoom(name string, w http.ResponseWriter) bool {
+// addRoom creates the room on this node as of t, unless it exists. The global
+// lock must be held for writing.
+func addRoom(name string, t time.Time) error {
+	if reserved[name] {
+		return errReserved
+	}
+
 	if _, ok := rooms[name]; !ok {
 		if len(rooms)+1 > maxRoomCount {
-			http.Error(w, "too many rooms", http.StatusBadRequest)
-			return false
+			return errTooManyRooms
+		}
+
+		if err := store.CreateRoom(name); err != nil {
+			return err
 		}
 
-		rooms[name] = room{msgs: make([]msg, 0)}
+		rooms[name] = newRoom(t)
+		emit(roomCreated{room: name})
 	}
 
-	return true
+	return nil
 }
 
-func printChat(name string, w http.ResponseWriter) {
-	fmt.Fprintf(w, "<pre>")
-
-	for _, m := range rooms[name].msgs {
-		fmt.Fprintf(w, "%s: %s\n\n", m.t, m.s)
+// newRoom returns an empty room, last active at t.
+func newRoom(t time.Time) *room {
+	return &room{
+		last:  t,
+		stats: newRoomStats(),
+		idle:  make(chan struct{}),
 	}
-
-	fmt.Fprintf(w, "</pre>")
 }
 
-func get(name string, w http.ResponseWriter, r *http.Request) {
-	pruneRooms()
+// lockRoom returns the room, creating it if needed, with the global lock
+// held for reading and the mu of the room held, until its unlock. The global
+// lock must not be held.
+func lockRoom(name string) (*room, error) {
+	for {
+		lock.RLock()
+		if rm, ok := rooms[name]; ok {
+			rm.mu.Lock()
+			return rm, nil
+		}
+		lock.RUnlock()
 
-	if !tryCreateRoom(name, w) {
-		return
-	}
+		lock.Lock()
+		err := createRoom(name)
+		lock.Unlock()
 
-	w.Header().Set("Content-Security-Policy", "default-src 'none';"+
-		"script-src 'self'; connect-src 'self'")
+		if err != nil {
+			return nil, err
+		}
+	}
+}
 
-	fmt.Fprintf(w, roomStart, name, name, name, maxMsgLen)
-	printChat(name, w)
-	fmt.Fprint(w, roomEnd)
+// rlockRoom is lockRoom for rooms that exist, holding nothing if there is no
+// such room.
+func rlockRoom(name string) (*room, bool) {
+	lock.RLock()
+	rm, ok := rooms[name]
+	if !ok {
+		lock.RUnlock()
+		return nil, false
+	}
+	rm.mu.Lock()
+	return rm, true
 }
 
-func patch(name string, w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Security-Policy", "default-src 'none';")
-	w.Header().Set("Content-Type", "text/plain")
+// seqOf returns the seq of the room, or 0 if there is no such room. The
+// global lock must be held for writing.
+func seqOf(name string) uint64 {
+	if rm, ok := rooms[name]; ok {
+		return rm.seq
+	}
+	return 0
+}
 
-	printChat(name, w)
+// unlock releases the room locked by lockRoom or rlockRoom.
+func (rm *room) unlock() {
+	rm.mu.Unlock()
+	lock.RUnlock()
 }
 
-func post(name string, w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "form invalid", http.StatusBadRequest)
-		return
+func tryCreateRoom(name string, w http.ResponseWriter,
+	r *http.Request) bool {
+	if err := createRoom(name); err != nil {
+		pageError(w, r, err.Error(), http.StatusBadRequest)
+		return false
 	}
 
-	str := r.PostFormValue("msg")
+	return true
+}
 
-	if len(str) > maxMsgLen {
-		http.Error(w, "msg too long", http.StatusBadRequest)
-		return
+// cleanMsg validates str and returns it trimmed and escaped, ready to be
+// stored.
+func cleanMsg(str string) (string, error) {
+	if len(str) > maxMsgLen*utf8.UTFMax {
+		return "", errMsgTooLong
 	}
 
+	if !utf8.ValidString(str) {
+		return "", errBadMsg
+	}
+
+	// Normalize and trim first, so that limits and duplicate checks see
+	// the same text however it was composed or sent.
+	str = norm.NFC.String(str)
 	str = strings.Replace(str, "\r", "", -1)
 	str = strings.TrimSpace(str)
 
+	if utf8.RuneCountInString(str) > maxMsgLen {
+		return "", errMsgTooLong
+	}
+
 	if !validMsg.MatchString(str) {
-		http.Error(w, "bad msg", http.StatusBadRequest)
-		return
+		return "", errBadMsg
+	}
+
+	return html.EscapeString(str), nil
+}
+
+// addMsg validates str and prepends it to the room on behalf of the client
+// id, creating the room if needed, returning its sequence number. Empty
+// messages and repeats of a message still in the history are dropped without
+// error, as sequence number 0. In pre-moderated rooms the msg is queued
+// instead, and errHeld returned. The global lock must not be held.
+func addMsg(name, str, id string) (uint64, error) {
+	return addMsgFrom(name, str, id, "")
+}
+
+// addMsgFrom is addMsg for a session or bridge relaying msgs back where they
+// came from, which skips those posted from it: the msg is marked from it
+// before anyone can see it.
+func addMsgFrom(name, str, id, from string) (uint64, error) {
+	if following {
+		return 0, errStandby
+	}
+	if raftFollower() {
+		return 0, errNotLeader
+	}
+
+	str, err := cleanMsg(str)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkTrust(name, str, id); err != nil {
+		return 0, err
 	}
 
+	if str, err = moderate(name, str, id); err != nil {
+		return 0, err
+	}
+
+	if str, err = beforePost(name, str); err != nil {
+		return 0, err
+	}
+
+	return submitMsg(name, str, id, from)
+}
+
+// appendMsg prepends the already cleaned str to the room, returning its
+// sequence number, or 0 if it was dropped. The global lock must not be held.
+func appendMsg(name, str, id, from string) (uint64, error) {
 	if str == "" {
-		http.Redirect(w, r, name, http.StatusSeeOther)
-		return
+		return 0, nil
+	}
+
+	if raftNode != nil {
+		return raftAppend(name, str, id, from)
 	}
 
-	str = html.EscapeString(str)
+	return addToRoom(name, str, id, from, time.Now().UTC())
+}
 
-	if !tryCreateRoom(name, w) {
-		return
+// addToRoom prepends str to the room as posted at now, returning its sequence
+// number, or 0 if it was dropped. No lock is held while the msg is stored, so
+// a slow store only holds up the room being posted to. The global lock must
+// not be held.
+func addToRoom(name, str, id, from string, now time.Time) (uint64, error) {
+	rm, err := lockRoom(name)
+	for err == nil && rm.posting {
+		idle := rm.idle
+		rm.unlock()
+		<-idle
+		rm, err = lockRoom(name)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if upgrading {
+		rm.unlock()
+		return 0, errUpgrading
+	}
+
+	for i := 0; i < rm.msgs.Len(); i++ {
+		if rm.msgs.At(i).s == str {
+			rm.unlock()
+			return 0, nil
+		}
+	}
+
+	rm.posting = true
+	seq := rm.seq
+	rm.unlock()
+
+	m := Message{
+		Seq:  nextSeq(name, seq),
+		Time: now,
+		HTML: str,
+	}
+	err = store.AppendMessage(name, m)
+
+	// Rooms posting are neither pruned, renamed nor merged, so rm is
+	// still the room.
+	lock.RLock()
+	rm.mu.Lock()
+	defer rm.unlock()
+
+	rm.posting = false
+	close(rm.idle)
+	rm.idle = make(chan struct{})
+	roomFree.Broadcast()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !rm.add(m, from) {
+		return 0, nil
+	}
+
+	rm.stats.count(m.Time, id)
+	server.count(m.Time)
+
+	emit(msgPosted{room: name, id: id, from: from, msg: m})
+
+	return m.Seq, nil
+}
+
+// add inserts m among the msgs of the room, reporting whether it was new.
+// Msgs are newest first, but msgs from other instances may arrive out of
+// order, as may those posted concurrently.
+func (rm *room) add(m Message, from string) bool {
+	nm := msg{
+		s:    m.HTML,
+		t:    m.Time.Format("2006-01-02 15:04"),
+		at:   m.Time,
+		seq:  m.Seq,
+		from: from,
 	}
 
-	rm := rooms[name]
+	if rm.msgs.Len() == 0 || m.Seq > rm.msgs.At(0).seq {
+		rm.msgs.push(nm)
+	} else {
+		i := 0
+		for i < rm.msgs.Len() && rm.msgs.At(i).seq > m.Seq {
+			i++
+		}
+		if i < rm.msgs.Len() && rm.msgs.At(i).seq == m.Seq {
+			return false
+		}
+		if i >= maxMsgsCount {
+			return false
+		}
+
+		msgs := rm.msgs.slice()
+		msgs = append(msgs[:i], append([]msg{nm}, msgs[i:]...)...)
+		rm.msgs = ringOf(msgs)
+	}
 
-	for _, m := range rm.msgs {
-		if m.s == str {
-			http.Redirect(w, r, name, http.StatusSeeOther)
+	if m.Seq > rm.seq {
+		rm.seq = m.Seq
+	}
+	if m.Time.After(rm.last) {
+		rm.last = m.Time
+	}
+
+	return true
+}
+
+// waitRooms waits until none of the rooms is posting, releasing the global
+// lock meanwhile. The global lock must be held for writing.
+func waitRooms(names ...string) {
+	for {
+		busy := false
+		for _, name := range names {
+			if rm, ok := rooms[name]; ok && rm.posting {
+				busy = true
+			}
+		}
+		if !busy {
 			return
 		}
+		roomFree.Wait()
+	}
+}
+
+// scheduleMsg validates str now and posts it to the room after d, which may
+// not exceed the room lifespan. The global lock must not be held.
+func scheduleMsg(name, str, id string, d time.Duration) error {
+	if following {
+		return errStandby
+	}
+	if raftFollower() {
+		return errNotLeader
+	}
+
+	if d <= 0 || d > lifespan {
+		return errBadDelay
+	}
+
+	str, err := cleanMsg(str)
+	if err != nil {
+		return err
 	}
 
-	w.Header().Set("Content-Security-Policy", "default-src 'none';")
+	if err := checkTrust(name, str, id); err != nil {
+		return err
+	}
+
+	if str, err = moderate(name, str, id); err != nil {
+		return err
+	}
+
+	if str, err = beforePost(name, str); err != nil {
+		return err
+	}
 
-	rm.last = time.Now().UTC()
-	rm.msgs = append([]msg{{
-		s: str,
-		t: rm.last.Format("2006-01-02 15:04"),
-	}}, rm.msgs...)
+	rm, err := lockRoom(name)
+	if err != nil {
+		return err
+	}
 
-	if len(rm.msgs) > maxMsgsCount {
-		rm.msgs = rm.msgs[:maxMsgsCount]
+	if rm.scheduled >= maxScheduled {
+		rm.unlock()
+		return errTooScheduled
 	}
+	rm.scheduled++
+
+	gen := purged[name]
+	rm.unlock()
+
+	time.AfterFunc(d, func() {
+		lock.Lock()
+		if purged[name] != gen {
+			lock.Unlock()
+			return
+		}
+		if rm, ok := rooms[name]; ok {
+			rm.scheduled--
+		}
+		lock.Unlock()
+
+		_, err := submitMsg(name, str, id, "")
+		if err != nil && err != errHeld {
+			log.Printf("scheduled msg for %s: %v", name, err)
+		}
+	})
 
-	rooms[name] = rm
+	return nil
+}
 
-	http.Redirect(w, r, name, http.StatusSeeOther)
+func printChat(rm *room, w io.Writer) {
+	printBanner(w)
+	io.WriteString(w, "<pre>")
+	io.WriteString(w, rm.msgs.html())
+	io.WriteString(w, "</pre>")
 }
 
-func home(w http.ResponseWriter, r *http.Request) {
-	if name := r.URL.Query().Get("name"); name != "" {
-		http.Redirect(w, r, "/"+name, http.StatusSeeOther)
+// printMsg writes m as one element, so clients applying deltas can trim old
+// msgs. The text is isolated with <bdi> so right-to-left text displays
+// correctly and cannot reorder the timestamp or neighbouring messages.
+func printMsg(w io.Writer, m msg) {
+	io.WriteString(w, "<span>")
+	io.WriteString(w, m.t)
+	io.WriteString(w, ": <bdi>")
+	io.WriteString(w, m.s)
+	io.WriteString(w, "</bdi>\n\n</span>")
+}
+
+// wantsPlain reports whether the client should be served plain text rather
+// than HTML, either because it asked with ?plain=1 or because it looks like a
+// command-line tool.
+func wantsPlain(r *http.Request) bool {
+	return r.URL.Query().Get("plain") == "1" ||
+		plainAgents.MatchString(r.UserAgent())
+}
+
+// printPlain writes the msgs of the room within mr. X-Seq is set to the
+// latest sequence number, for clients to resume from with ?after=. The mu of
+// the room must be held.
+func printPlain(name string, w http.ResponseWriter, mr msgRange) {
+	setCSP(w, "default-src 'none';")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Seq", strconv.FormatUint(rooms[name].seq, 10))
+
+	b := getBuf()
+	defer putBuf(b)
+
+	if banner != "" {
+		b.WriteString("notice: ")
+		b.WriteString(html.UnescapeString(banner))
+		b.WriteByte('\n')
+	}
+
+	// Oldest first, so the newest message ends up above the prompt.
+	msgs := rooms[name].msgs
+	for i := msgs.Len() - 1; i >= 0; i-- {
+		if m := msgs.At(i); mr.has(m) {
+			b.WriteString(m.t)
+			b.WriteString(": ")
+			b.WriteString(html.UnescapeString(m.s))
+			b.WriteByte('\n')
+		}
+	}
+
+	w.Write(b.Bytes())
+}
+
+// raw serves /name/raw, the transcript of an existing room as plain text
+// regardless of the client.
+func raw(name string, w http.ResponseWriter, r *http.Request) {
+	rm, ok := rooms[name]
+	if !ok {
+		http.Error(w, "no such room", http.StatusNotFound)
 		return
 	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
 
-	fmt.Fprint(w, welcomeStart)
-	for name := range rooms {
-		fmt.Fprintf(w, `<p><a href="/%s">%s &gt;</a></p>`, name,
-			name)
+	mr, err := parseRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if notModified(name, w, r) {
+		return
 	}
-	fmt.Fprintf(w, welcomeEnd, maxNameLen, validName.String(),
-		lifespan)
+
+	printPlain(name, w, mr)
 }
 
-func realtime(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+// transcript serves /name/transcript, the plain text transcript of an
+// existing room as a file to save.
+func transcript(name string, w http.ResponseWriter, r *http.Request) {
+	rm, ok := rooms[name]
+	if !ok {
+		http.Error(w, "no such room", http.StatusNotFound)
 		return
 	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
 
-	w.Header().Set("Content-Security-Policy", "default-src 'none';")
-	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		`attachment; filename="%s-%s.txt"`, name,
+		time.Now().UTC().Format("20060102")))
 
-	fmt.Fprint(w, realtimeJS)
+	printPlain(name, w, msgRange{})
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET", "PATCH", "POST":
-		break
-	default:
-		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+func get(name string, w http.ResponseWriter, r *http.Request) {
+	mr, err := parseRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	name := r.URL.Path[1:]
+	// Command-line tools get plain text, by their User-Agent.
+	w.Header().Set("Vary", "Accept, User-Agent")
 
-	if len(name) > maxNameLen {
-		http.Error(w, "name too long", http.StatusBadRequest)
+	_, exists := rooms[name]
+
+	if !tryCreateRoom(name, w, r) {
 		return
-	} else if !validName.MatchString(name) {
-		http.Error(w, "bad name", http.StatusBadRequest)
+	}
+
+	// With Raft the creator is set through the log, releasing the global
+	// lock, so it is issued before the room is looked up.
+	if !exists {
+		issueCreator(name, w)
+	}
+
+	rm, ok := rooms[name]
+	if !ok {
+		pageError(w, r, errNoSuchRoom.Error(), http.StatusNotFound)
 		return
 	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
 
-	w.Header().Set("Referrer-Policy", "no-referrer")
-	w.Header().Set("Strict-Transport-Security", "max-age=31536000;"+
-		"includeSubDomains;preload")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.Header().Set("X-Frame-Options", "deny")
-	w.Header().Set("X-XSS-Protection", "1")
+	if exists && notModified(name, w, r) {
+		return
+	}
 
-	lock.Lock()
+	if wantsJSON(r) {
+		apiJSON(w, http.StatusOK, apiMsgList(rm, mr))
+		return
+	}
 
-	if name == "" {
-		home(w, r)
+	if wantsPlain(r) || mr != (msgRange{}) {
+		printPlain(name, w, mr)
+		return
+	}
+
+	if nojs {
+		setCSP(w, "default-src 'none';")
 	} else {
-		switch r.Method {
-		case "GET":
-			get(name, w, r)
-		case "PATCH":
-			patch(name, w, r)
-		case "POST":
-			post(name, w, r)
-		}
+		setCSP(w, "default-src 'none';"+
+			"script-src 'self'; connect-src 'self'")
 	}
 
-	lock.Unlock()
+	controls, chat := getBuf(), getBuf()
+	defer putBuf(controls)
+	defer putBuf(chat)
+
+	printRenameForm(name, controls, r)
+	printDigestForm(name, controls)
+	printChat(rm, chat)
+
+	renderPage(w, "room.html", roomData{
+		Prefix:    prefix,
+		Name:      name,
+		Controls:  template.HTML(controls.String()),
+		MaxMsgLen: maxMsgLen,
+		Chat:      template.HTML(chat.String()),
+		NoJS:      nojs,
+		Archive:   archiveDir != "",
+		Integrity: integrity("realtime.js"),
+	})
 }
 
-func main() {
-	if err := openshim2.LazySysctls(); err != nil {
-		log.Fatal(err)
+// notModified sets Last-Modified for the room and reports whether it has not
+// changed since If-Modified-Since, replying 304 Not Modified if so.
+func notModified(name string, w http.ResponseWriter, r *http.Request) bool {
+	mod := rooms[name].last
+	if bannerSet.After(mod) {
+		mod = bannerSet
 	}
+	mod = mod.Truncate(time.Second)
 
-	if err := openshim2.Pledge("stdio inet", ""); err != nil {
-		log.Fatal(err)
+	w.Header().Set("Last-Modified", mod.Format(http.TimeFormat))
+
+	t, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || mod.After(t) {
+		return false
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handler)
-	mux.HandleFunc("/realtime.js", realtime)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
 
-	srv := &http.Server{
-		Addr:    ":8444",
-		Handler: mux,
+// polls counts PATCH requests per second, as a measure of load. Polls only
+// hold the global lock for reading, so polls has its own.
+var polls struct {
+	sync.Mutex
+	sec     int64
+	n, last int
+}
+
+// pollInterval is the polling interval advertised to clients: longer for
+// quiet rooms, and stretched further when the server is busy.
+func pollInterval(rm *room) time.Duration {
+	polls.Lock()
+	if now := time.Now().Unix(); now != polls.sec {
+		if now == polls.sec+1 {
+			polls.last = polls.n
+		} else {
+			polls.last = 0
+		}
+		polls.sec, polls.n = now, 0
 	}
+	polls.n++
+	last := polls.last
+	polls.Unlock()
 
-	go func() {
-		ticker := time.NewTicker(lifespan)
-		quit := make(chan struct{})
+	d := minPoll
+
+	switch idle := time.Since(rm.last); {
+	case idle > time.Hour:
+		d = 15 * time.Second
+	case idle > 10*time.Minute:
+		d = 5 * time.Second
+	}
+
+	if last > busyPolls {
+		d *= time.Duration(last/busyPolls + 1)
+	}
+
+	if d > maxPoll {
+		d = maxPoll
+	}
+
+	return d
+}
+
+// patch serves polls for the rendered chat. With ?since= (a sequence number
+// from X-Seq) only newer msgs are sent, marked with X-Delta, if the history
+// still reaches back that far. With ?wait= (e.g. 30s) it is a long poll,
+// answered when a msg arrives or the wait is up; the global lock, held for
+// reading, is released while waiting. Rooms that do not exist read as empty.
+func patch(name string, w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	delta := err == nil
 
-		for {
+	if wait := r.URL.Query().Get("wait"); wait != "" {
+		d, err := time.ParseDuration(wait)
+		if err != nil || d < 0 {
+			http.Error(w, "bad wait", http.StatusBadRequest)
+			return
+		}
+		if d > maxWait {
+			d = maxWait
+		}
+
+		var sub *watcher
+		if rm, ok := rooms[name]; ok {
+			rm.mu.Lock()
+			if !delta || since >= rm.seq {
+				sub = watch(name)
+			}
+			rm.mu.Unlock()
+		}
+
+		if sub != nil {
+			timer := time.NewTimer(d)
+
+			lock.RUnlock()
 			select {
-			case <-ticker.C:
-				lock.Lock()
-				pruneRooms()
-				lock.Unlock()
-			case <-quit:
-				ticker.Stop()
-				return
+			case <-sub.c:
+			case <-timer.C:
+			case <-shutdown:
+			case <-r.Context().Done():
 			}
+			lock.RLock()
+
+			timer.Stop()
+			sub.stop()
 		}
-	}()
+	}
 
-	graceful.Graceful(srv, func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatal(err)
+	rm, ok := rooms[name]
+	if !ok {
+		rm = newRoom(time.Time{})
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	setCSP(w, "default-src 'none';")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("X-Poll-Interval",
+		strconv.FormatInt(pollInterval(rm).Milliseconds(), 10))
+	w.Header().Set("X-Seq", strconv.FormatUint(rm.seq, 10))
+
+	// The room changes only with new msgs or the banner, and last tells a
+	// recreated room apart from the old one.
+	etag := fmt.Sprintf(`"%x.%x.%x"`, rm.last.UnixNano(), rm.seq,
+		crc32.ChecksumIEEE([]byte(banner)))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Deltas are impossible once msgs after since were trimmed, or if the
+	// room started over.
+	if n := rm.msgs.Len(); delta && since <= rm.seq &&
+		(n == 0 || rm.msgs.At(n-1).seq <= since+1) {
+		w.Header().Set("X-Delta", "1")
+
+		b := getBuf()
+		for i := 0; i < rm.msgs.Len(); i++ {
+			if m := rm.msgs.At(i); m.seq > since {
+				printMsg(b, m)
+			}
 		}
-	}, os.Interrupt)
+		w.Write(b.Bytes())
+		putBuf(b)
+		return
+	}
+
+	b := getBuf()
+	printChat(rm, b)
+	w.Write(b.Bytes())
+	putBuf(b)
+}
+
+// post adds the msg in the form to the room. The global lock must not be
+// held, as posting takes what it needs.
+func post(name string, w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "form invalid", http.StatusBadRequest)
+		return
+	}
+
+	plain := wantsPlain(r)
+
+	// Plain clients are answered with the transcript instead of a
+	// redirect back to the room page.
+	done := func() {
+		if !plain {
+			http.Redirect(w, r, prefix+"/"+name,
+				http.StatusSeeOther)
+		} else if rm, ok := rlockRoom(name); ok {
+			printPlain(name, w, msgRange{})
+			rm.unlock()
+		}
+	}
+
+	str := r.PostFormValue("msg")
+
+	// Plain clients may also send the message as the raw request body,
+	// e.g. curl -H 'Content-Type: text/plain' --data-binary @-.
+	if _, ok := r.PostForm["msg"]; !ok && plain {
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body,
+			maxMsgLen*utf8.UTFMax+2))
+		if err != nil {
+			http.Error(w, "body invalid", http.StatusBadRequest)
+			return
+		}
+		str = string(b)
+		str = strings.TrimSuffix(str, "\n")
+		str = strings.TrimSuffix(str, "\r")
+	}
+
+	setCSP(w, "default-src 'none';")
+
+	lock.RLock()
+	_, exists := rooms[name]
+	lock.RUnlock()
+
+	// An optional delay ("in", e.g. 90m) holds the msg back for later.
+	var err error
+	if in := r.FormValue("in"); in != "" {
+		d, perr := time.ParseDuration(in)
+		if perr != nil {
+			http.Error(w, errBadDelay.Error(), http.StatusBadRequest)
+			return
+		}
+		err = scheduleMsg(name, str, clientID(clientAddr(r)), d)
+	} else {
+		_, err = addMsg(name, str, clientID(clientAddr(r)))
+	}
+
+	if err == errHeld {
+		if plain {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintln(w, err)
+			return
+		}
+		err = nil
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), postStatus(err))
+		return
+	}
+
+	if !exists {
+		lock.Lock()
+		if rm, ok := rooms[name]; ok && rm.creator == nil {
+			issueCreator(name, w)
+		}
+		lock.Unlock()
+	}
+
+	done()
+}
+
+// postStatus is the HTTP status for an error posting a msg.
+func postStatus(err error) int {
+	switch err {
+	case errSlowDown:
+		return http.StatusTooManyRequests
+	case errStandby, errNotLeader, errUpgrading:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+func home(w http.ResponseWriter, r *http.Request) {
+	if name := r.URL.Query().Get("name"); name != "" {
+		http.Redirect(w, r, prefix+"/"+strings.ToLower(name),
+			http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept, User-Agent")
+
+	if wantsJSON(r) {
+		setCSP(w, "default-src 'none';")
+		apiRooms(w)
+		return
+	}
+
+	if wantsPlain(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for name := range rooms {
+			fmt.Fprintln(w, name)
+		}
+		return
+	}
+
+	setCSP(w, "default-src 'none';")
+
+	var b strings.Builder
+	printBanner(&b)
+
+	names := make([]string, 0, len(rooms))
+	for name := range rooms {
+		names = append(names, name)
+	}
+
+	renderPage(w, "welcome.html", welcomeData{
+		Prefix:      prefix,
+		Banner:      template.HTML(b.String()),
+		Rooms:       names,
+		MaxNameLen:  maxNameLen,
+		NamePattern: foldName.String(),
+		Version:     versionString(),
+	})
+}
+
+// subpage serves /name/sub.
+func subpage(name, sub string, w http.ResponseWriter, r *http.Request) {
+	method := "GET"
+	if sub == "rename" {
+		method = "POST"
+	}
+
+	// Digest links are followed with GET, and forms post back.
+	if r.Method != method && sub != "digest" {
+		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch sub {
+	case "digest":
+		digest(name, w, r)
+	case "feed.atom":
+		atom(name, w, r)
+	case "feed.json":
+		jsonfeed(name, w, r)
+	case "raw":
+		raw(name, w, r)
+	case "stats":
+		roomStatsPage(name, w, r)
+	case "tail":
+		tail(name, w, r)
+	case "transcript":
+		transcript(name, w, r)
+	case "rename":
+		rename(name, w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// redirectRoom permanently redirects r to the same page of the room name.
+func redirectRoom(name, sub string, w http.ResponseWriter, r *http.Request) {
+	u := *r.URL
+	u.Path = prefix + "/" + name
+	if sub != "" {
+		u.Path += "/" + sub
+	}
+
+	// 308 keeps the method and body of posts and polls.
+	code := http.StatusPermanentRedirect
+	if r.Method == "GET" {
+		code = http.StatusMovedPermanently
+	}
+
+	http.Redirect(w, r, u.String(), code)
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "PATCH", "POST":
+		break
+	default:
+		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Paths are /name or /name/sub for pages belonging to a room.
+	name, sub := r.URL.Path[1:], ""
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name, sub = name[:i], name[i+1:]
+	}
+
+	if len(name) > maxNameLen {
+		pageError(w, r, "name too long", http.StatusBadRequest)
+		return
+	} else if name != strings.ToLower(name) && foldName.MatchString(name) {
+		redirectRoom(strings.ToLower(name), sub, w, r)
+		return
+	} else if !validName.MatchString(name) {
+		pageError(w, r, "bad name", http.StatusBadRequest)
+		return
+	}
+
+	securityHeaders(w)
+
+	if r.Method != "POST" && !limit(readLimit, w, r) {
+		return
+	}
+
+	// Blocklisted clients may still post, but slowly.
+	if r.Method == "POST" && listed(clientAddr(r)) &&
+		!limit(listedLimit, w, r) {
+		return
+	}
+
+	// Day logs are files, read without holding up the rooms.
+	if !reserved[name] &&
+		(sub == "archive" || strings.HasPrefix(sub, "archive/")) {
+		days(name, sub, w, r)
+		return
+	}
+
+	// Polls, views of rooms and the pages that only read share the lock,
+	// so many clients may read at once.
+	lock.RLock()
+	if reading(name, sub, r) {
+		if _, ok := rooms[name]; !ok {
+			if to, ok := resolve(name); ok {
+				lock.RUnlock()
+				redirectRoom(to, sub, w, r)
+				return
+			}
+		}
+
+		switch {
+		case name == "":
+			home(w, r)
+		case name == "about":
+			about(w, r)
+		case sub != "":
+			subpage(name, sub, w, r)
+		case r.Method == "GET":
+			get(name, w, r)
+		default:
+			patch(name, w, r)
+		}
+		lock.RUnlock()
+		return
+	}
+	lock.RUnlock()
+
+	lock.Lock()
+
+	if _, ok := rooms[name]; !ok {
+		if to, ok := resolve(name); ok {
+			lock.Unlock()
+			redirectRoom(to, sub, w, r)
+			return
+		}
+	}
+
+	// Reading existing rooms is never restricted by region.
+	if _, ok := rooms[name]; name != "" && sub == "" &&
+		(r.Method == "POST" || r.Method == "GET" && !ok) &&
+		geoBlocked(clientAddr(r), !ok) {
+		lock.Unlock()
+		pageError(w, r, errGeoBlocked.Error(), http.StatusForbidden)
+		return
+	}
+
+	if name == "" {
+		home(w, r)
+	} else if name == "about" && sub == "" {
+		about(w, r)
+	} else if name == "admin" {
+		admin(sub, w, r)
+	} else if sub != "" {
+		subpage(name, sub, w, r)
+	} else {
+		switch r.Method {
+		case "GET":
+			pruneRooms()
+			get(name, w, r)
+		case "POST":
+			// Posts take the locks they need themselves, so posts
+			// to different rooms do not wait on each other.
+			lock.Unlock()
+			post(name, w, r)
+			return
+		}
+	}
+
+	lock.Unlock()
+}
+
+// reading reports whether r only reads: the home and about pages, subpages
+// besides digests and renames, polls, and views of rooms not due to be
+// pruned, which would otherwise be pruned and created anew. The global lock
+// must be held, at least for reading.
+func reading(name, sub string, r *http.Request) bool {
+	switch {
+	case name == "admin":
+		return false
+	case name == "" || name == "about":
+		return r.Method == "GET"
+	case sub != "":
+		return r.Method == "GET" && sub != "digest" && sub != "rename"
+	case r.Method == "PATCH":
+		return true
+	}
+
+	rm, ok := rooms[name]
+	if r.Method != "GET" || !ok {
+		return false
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	return rm.scheduled != 0 || rm.posting ||
+		time.Now().UTC().Sub(rm.last) <= lifespan
+}
+
+// routes returns the pages and endpoints of the server.
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/events/", events)
+	mux.HandleFunc("/api/v1/", api)
+	mux.HandleFunc("/hooks/", hookHandler)
+	if matrixHomeserver != "" {
+		mux.HandleFunc("/_matrix/app/v1/", matrixHandler)
+	}
+	if archiveDir != "" {
+		mux.HandleFunc("/archive/", archive)
+	}
+	mux.HandleFunc("/static/", static)
+	if !nojs {
+		// Pages cached before assets moved to /static/ load it here.
+		mux.HandleFunc("/realtime.js", static)
+		mux.HandleFunc("/ws/", wsHandler)
+	}
+	return mux
+}
+
+// pruneLoop deletes expired rooms every lifespan.
+func pruneLoop() {
+	for range time.Tick(lifespan) {
+		lock.Lock()
+		pruneRooms()
+		lock.Unlock()
+	}
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		log.Printf("%s %s %s %s", r.RemoteAddr, r.Method, r.URL,
+			time.Since(start))
+	})
+}
+
+// serveHTTP serves srv on ln, with TLS if secure, until srv is shut down.
+// Serving sets srv.TLSConfig for HTTP/2, so it cannot be checked instead.
+func serveHTTP(srv *http.Server, ln net.Listener, secure bool) {
+	var err error
+	if secure {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// serve calls handle in a new goroutine for each connection accepted on ln,
+// until ln is closed.
+func serve(ln net.Listener, handle func(net.Conn)) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println(err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		go handle(c)
+	}
+}
+
+// Main runs the chat command with os.Args: the server, or one of the
+// subcommands.
+func Main() {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			if err := cmd(args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		} else if args[0] == "serve" {
+			args = args[1:]
+		}
+	}
+
+	flag.BoolVar(&dev, "dev", false, "development mode (no sandbox, "+
+		"localhost only, verbose logging, pprof, no HSTS)")
+	noSandbox := flag.Bool("no-sandbox", false, "run without the "+
+		"sandbox, e.g. on FreeBSD with features capability mode "+
+		"forbids")
+	flag.BoolVar(&nojs, "nojs", false, "serve rooms without JavaScript; "+
+		"readers refresh manually")
+	templatesDir := flag.String("templates", "", "directory of "+
+		"welcome.html, room.html and error.html templates replacing "+
+		"the built-in pages")
+	flag.StringVar(&gopherAddr, "gopher", "", "gopher listen address "+
+		"(e.g. :70), disabled if empty")
+	flag.StringVar(&gopherHost, "gopher-host", "", "hostname in gopher "+
+		"menus (default: listener address)")
+	flag.StringVar(&lineAddr, "line", "", "line-mode TCP listen address "+
+		"(e.g. :9999), disabled if empty")
+	flag.StringVar(&ircAddr, "irc", "", "IRC gateway listen address "+
+		"(e.g. :6667), disabled if empty")
+	flag.StringVar(&nntpAddr, "nntp", "", "read-only NNTP listen address "+
+		"(e.g. :119), disabled if empty")
+	flag.StringVar(&smtpAddr, "smtp", "", "SMTP listen address (e.g. "+
+		":25) accepting mail to room@host, disabled if empty")
+	flag.StringVar(&smtpDomain, "smtp-domain", "", "only accept mail "+
+		"to this domain, if set")
+	flag.StringVar(&geminiAddr, "gemini", "", "Gemini listen address "+
+		"(e.g. :1965), disabled if empty; needs -tls-cert or -acme-host")
+	flag.StringVar(&http3Addr, "http3", "", "HTTP/3 UDP listen address "+
+		"(e.g. :8444), advertised by Alt-Svc, disabled if empty; "+
+		"needs -tls-cert or -acme-host")
+	flag.StringVar(&xmppAddr, "xmpp", "", "XMPP server component "+
+		"address (e.g. localhost:5347) to serve rooms as MUCs, "+
+		"disabled if empty")
+	flag.StringVar(&xmppDomain, "xmpp-domain", "", "XMPP component "+
+		"domain (e.g. rooms.example.com)")
+	xmppSecretFile := flag.String("xmpp-secret-file", "", "file holding "+
+		"the XMPP component secret")
+	discordMap := flag.String("discord", "", "rooms to bridge to "+
+		"Discord channels, as comma-separated room=channelID")
+	discordTokenFile := flag.String("discord-token-file", "", "file "+
+		"holding the Discord bot token for -discord")
+	flag.StringVar(&ircRelayURL, "irc-relay", "", "IRC network to "+
+		"mirror rooms to, as irc://host:port or ircs://host:port, "+
+		"disabled if empty")
+	flag.StringVar(&ircRelayNick, "irc-relay-nick", "chatrelay", "nick "+
+		"of the -irc-relay client")
+	ircRelayPasswordFile := flag.String("irc-relay-password-file", "",
+		"file holding the -irc-relay server password, if any")
+	ircRelayMap := flag.String("irc-relay-channels", "", "rooms to "+
+		"mirror to -irc-relay channels, as comma-separated room=#channel")
+	flag.BoolVar(&ircRelayBack, "irc-relay-back", false, "also post "+
+		"what others say in -irc-relay channels to the rooms")
+	flag.StringVar(&digestSMTP, "digest-smtp", "", "mail server "+
+		"(host:port) to send daily room digests through, letting "+
+		"people subscribe on room pages; disabled if empty")
+	flag.StringVar(&digestFrom, "digest-from", "", "From address of "+
+		"digests")
+	flag.StringVar(&digestUser, "digest-smtp-user", "", "user to log "+
+		"in to -digest-smtp as, if any")
+	digestPasswordFile := flag.String("digest-smtp-password-file", "",
+		"file holding the password for -digest-smtp-user")
+	flag.StringVar(&digestFile, "digest-file", "digests.json", "file "+
+		"to keep digest subscriptions in")
+	flag.StringVar(&matrixHomeserver, "matrix", "", "Matrix homeserver "+
+		"URL to bridge rooms to as an application service, disabled "+
+		"if empty")
+	flag.StringVar(&matrixDomain, "matrix-domain", "", "Matrix server "+
+		"name, for room aliases (e.g. example.com)")
+	flag.StringVar(&matrixUser, "matrix-user", "", "the application "+
+		"service's Matrix user (e.g. @chat:example.com)")
+	matrixASFile := flag.String("matrix-as-token-file", "", "file "+
+		"holding the application service's as_token")
+	matrixHSFile := flag.String("matrix-hs-token-file", "", "file "+
+		"holding the application service's hs_token")
+	flag.StringVar(&sshAddr, "ssh", "", "SSH listen address (e.g. :2222), "+
+		"disabled if empty")
+	flag.StringVar(&sshKey, "ssh-key", "", "SSH host private key file")
+	flag.StringVar(&sshAuthorizedKeys, "ssh-authorized-keys", "",
+		"authorized_keys file for SSH, anonymous if empty")
+	flag.StringVar(&grpcAddr, "grpc", "", "gRPC listen address (e.g. "+
+		":9090) serving the Chat service of chat.proto without TLS, "+
+		"disabled if empty")
+	flag.StringVar(&hsts, "hsts", hsts, "Strict-Transport-Security "+
+		"header, omitted if empty")
+	flag.StringVar(&frameAncestors, "frame-ancestors", frameAncestors,
+		"CSP frame-ancestors sources allowed to embed pages, "+
+			"unrestricted if empty")
+	flag.StringVar(&cspExtra, "csp-extra", "", "directives appended to "+
+		"every Content-Security-Policy")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "require a PROXY "+
+		"protocol header on HTTP connections")
+	proxies := flag.String("trusted-proxies", "", "comma-separated CIDRs "+
+		"of proxies whose X-Forwarded-For and X-Real-IP are trusted")
+	blocklists := flag.String("dnsbl", "", "comma-separated DNS blocklist "+
+		"zones; listed clients are limited to one post a minute")
+	geoFile := flag.String("geoip", "", "MaxMind country database (MMDB) "+
+		"for region restrictions, disabled if empty")
+	geoAllowList := flag.String("geoip-allow", "", "comma-separated "+
+		"countries allowed to create rooms (default: all)")
+	geoDenyList := flag.String("geoip-deny", "", "comma-separated "+
+		"countries denied from creating rooms")
+	flag.BoolVar(&geoPosting, "geoip-posting", false, "apply region "+
+		"restrictions to posting as well as room creation")
+	statsdAddr := flag.String("statsd", "", "statsd address to push "+
+		"metrics to (e.g. localhost:8125), disabled if empty")
+	statsdPrefix := flag.String("statsd-prefix", "chat.", "statsd "+
+		"metric name prefix")
+	statsdTags := flag.String("statsd-tags", "", "dogstatsd tags added "+
+		"to every metric (e.g. env:prod)")
+	adminTokenFile := flag.String("admin-token-file", "", "file holding "+
+		"the bearer token for /admin, disabled if empty")
+	printVersion := flag.Bool("version", false, "print version and exit")
+	flag.BoolVar(&premod, "premod", false, "hold every post for admin "+
+		"approval")
+	flag.StringVar(&moderateURL, "moderate-url", "", "moderation "+
+		"service each msg is POSTed to before acceptance, disabled if "+
+		"empty")
+	flag.DurationVar(&moderateTimeout, "moderate-timeout",
+		moderateTimeout, "moderation service timeout")
+	flag.BoolVar(&moderateFailClosed, "moderate-fail-closed", false,
+		"refuse msgs when the moderation service fails")
+	webhookURLs := flag.String("webhooks", "", "URLs to POST each new msg "+
+		"to as JSON, comma-separated, each prefixed by room= to only "+
+		"get that room's msgs")
+	hookTokensFile := flag.String("hook-tokens-file", "", "file of "+
+		"incoming webhooks, one \"room token\" per line, each "+
+		"posting to its room at /hooks/token")
+	webhookSecretFile := flag.String("webhook-secret-file", "", "file "+
+		"holding the key to sign -webhooks payloads with")
+	flag.DurationVar(&trustAfter, "trust-after", trustAfter, "time "+
+		"after a poster's first msg in a room until newcomer limits "+
+		"lift, 0 to disable")
+	listenAddr := flag.String("listen", "", "comma-separated HTTP "+
+		"listen addresses, each host:port or unix:/path for a unix "+
+		"socket (default :8444, or localhost:8444 with -dev); ignored "+
+		"when sockets are passed by systemd")
+	listenMode := flag.String("listen-mode", "0660", "permissions of "+
+		"-listen unix sockets")
+	flag.BoolVar(&upgrades, "upgrades", false, "on SIGUSR2, start the "+
+		"binary anew and hand it the listeners without dropping "+
+		"connections; needs -snapshot, and the sandbox then allows "+
+		"exec")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, "+
+		"reloaded on SIGHUP or change; serves plain HTTP if empty")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	acmeHosts := flag.String("acme-host", "", "comma-separated hosts to "+
+		"obtain and renew Let's Encrypt certificates for, instead of "+
+		"-tls-cert")
+	acmeDir := flag.String("acme-dir", "acme", "directory to keep the "+
+		"ACME account key and certificates in")
+	acmeHTTP := flag.String("acme-http", ":80", "listen address for "+
+		"-acme-host HTTP-01 challenges; other requests are redirected "+
+		"to HTTPS")
+	flag.StringVar(&followURL, "follow", "", "primary to replicate "+
+		"from as a read-only standby, taking over when it is down; "+
+		"needs the primary's -admin-token-file")
+	boltFile := flag.String("bolt", "", "bbolt file to keep rooms in "+
+		"across restarts, kept in memory only if empty")
+	redisAddr := flag.String("redis", "", "Redis address (e.g. "+
+		"localhost:6379) to keep rooms in, shared by instances")
+	redisPasswordFile := flag.String("redis-password-file", "", "file "+
+		"holding the Redis password, if any")
+	clustered := flag.Bool("cluster", false, "share new msgs with "+
+		"other instances using the same -redis, to run several behind "+
+		"a load balancer")
+	postgresDSN := flag.String("postgres", "", "PostgreSQL connection "+
+		"string (e.g. postgres://chat@localhost/chat) to keep rooms in")
+	raftAddr := flag.String("raft-addr", "", "address (e.g. "+
+		"10.0.0.1:7000) to replicate rooms with other nodes at using "+
+		"Raft, disabled if empty")
+	raftID := flag.String("raft-id", "", "this node's Raft ID, "+
+		"-raft-addr if empty")
+	raftDir := flag.String("raft-dir", "raft", "directory to keep the "+
+		"Raft log and snapshots in")
+	raftPeers := flag.String("raft-peers", "", "every node as "+
+		"id=addr, comma-separated, to start a new cluster with; this "+
+		"node alone if empty")
+	snapshotFile := flag.String("snapshot", "", "file to save rooms to "+
+		"on shutdown and restore them from on start")
+	flag.StringVar(&archiveDir, "archive", "", "directory to archive "+
+		"rooms to before they are pruned, and their msgs to by day as "+
+		"they are posted, disabled if empty")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3-compatible "+
+		"endpoint (e.g. https://s3.us-east-1.amazonaws.com) to upload "+
+		"archived rooms to, disabled if empty")
+	s3Bucket := flag.String("s3-bucket", "", "bucket for -s3-endpoint")
+	s3Region := flag.String("s3-region", "us-east-1", "region for "+
+		"-s3-endpoint")
+	s3KeyID := flag.String("s3-access-key-id", "", "access key ID for "+
+		"-s3-endpoint")
+	s3SecretFile := flag.String("s3-secret-file", "", "file holding the "+
+		"secret access key for -s3-endpoint")
+	snapshotInterval := flag.Duration("snapshot-interval", 5*time.Minute,
+		"also save the -snapshot this often, 0 to only save on "+
+			"shutdown")
+	flag.Usage = usage
+	_ = flag.CommandLine.Parse(args)
+
+	if *printVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if *adminTokenFile != "" {
+		b, err := ioutil.ReadFile(*adminTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if adminToken = strings.TrimSpace(string(b)); adminToken == "" {
+			log.Fatal("empty admin token")
+		}
+	}
+
+	if *geoFile != "" {
+		db, err := maxminddb.Open(*geoFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		geoDB = db
+		geoAllow = parseCountries(*geoAllowList)
+		geoDeny = parseCountries(*geoDenyList)
+	}
+
+	for _, zone := range strings.Split(*blocklists, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			dnsbls = append(dnsbls, zone)
+			outbound = true
+		}
+	}
+
+	if moderateURL != "" {
+		outbound = true
+	}
+
+	if *hookTokensFile != "" {
+		if err := loadHooks(*hookTokensFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *webhookURLs != "" {
+		hs, err := parseWebhooks(*webhookURLs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhooks = hs
+		if *webhookSecretFile != "" {
+			b, err := ioutil.ReadFile(*webhookSecretFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			webhookSecret = []byte(strings.TrimSpace(string(b)))
+		}
+		startWebhooks()
+		outbound = true
+	}
+
+	if xmppAddr != "" {
+		if xmppDomain == "" || *xmppSecretFile == "" {
+			log.Fatal("-xmpp needs -xmpp-domain and -xmpp-secret-file")
+		}
+		b, err := ioutil.ReadFile(*xmppSecretFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		xmppSecret = strings.TrimSpace(string(b))
+		outbound = true
+		go xmpp()
+	}
+
+	if matrixHomeserver != "" {
+		if matrixDomain == "" || matrixUser == "" ||
+			*matrixASFile == "" || *matrixHSFile == "" {
+			log.Fatal("-matrix needs -matrix-domain, -matrix-user, " +
+				"-matrix-as-token-file and -matrix-hs-token-file")
+		}
+		for _, t := range []struct {
+			file string
+			dst  *string
+		}{
+			{*matrixASFile, &matrixASToken},
+			{*matrixHSFile, &matrixHSToken},
+		} {
+			b, err := ioutil.ReadFile(t.file)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if *t.dst = strings.TrimSpace(string(b)); *t.dst == "" {
+				log.Fatal("empty matrix token")
+			}
+		}
+		outbound = true
+	}
+
+	if *discordMap != "" {
+		if *discordTokenFile == "" {
+			log.Fatal("-discord needs -discord-token-file")
+		}
+		b, err := ioutil.ReadFile(*discordTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if discordToken = strings.TrimSpace(string(b)); discordToken == "" {
+			log.Fatal("empty discord token")
+		}
+		if discordChannels, err = parseDiscordChannels(
+			*discordMap); err != nil {
+			log.Fatal(err)
+		}
+		outbound = true
+	}
+
+	if ircRelayURL != "" {
+		if *ircRelayMap == "" {
+			log.Fatal("-irc-relay needs -irc-relay-channels")
+		}
+		var err error
+		if ircRelayChannels, err = parseIRCRelayChannels(
+			*ircRelayMap); err != nil {
+			log.Fatal(err)
+		}
+		if *ircRelayPasswordFile != "" {
+			b, err := ioutil.ReadFile(*ircRelayPasswordFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ircRelayPassword = strings.TrimSpace(string(b))
+		}
+		outbound = true
+	}
+
+	if digestSMTP != "" {
+		if digestFrom == "" {
+			log.Fatal("-digest-smtp needs -digest-from")
+		}
+		if *digestPasswordFile != "" {
+			b, err := ioutil.ReadFile(*digestPasswordFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			digestPassword = strings.TrimSpace(string(b))
+		}
+		if err := loadDigests(); err != nil {
+			log.Fatal(err)
+		}
+		outbound, writes = true, true
+		go digestLoop()
+	}
+
+	if *templatesDir != "" {
+		var err error
+		if pages, err = parsePages(*templatesDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if followURL != "" {
+		if adminToken == "" {
+			log.Fatal("-follow needs -admin-token-file")
+		}
+		following, outbound = true, true
+		go follow()
+	}
+
+	var err error
+	if trustedProxies, err = parseTrustedProxies(*proxies); err != nil {
+		log.Fatal(err)
+	}
+
+	stores := 0
+	for _, s := range []string{*boltFile, *redisAddr, *postgresDSN} {
+		if s != "" {
+			stores++
+		}
+	}
+	if stores > 1 {
+		log.Fatal("-bolt, -redis and -postgres are exclusive")
+	}
+
+	if *raftAddr != "" {
+		if stores > 0 || *snapshotFile != "" || followURL != "" {
+			log.Fatal("-raft-addr keeps rooms itself, and is " +
+				"exclusive with -bolt, -redis, -postgres, " +
+				"-snapshot and -follow")
+		}
+		id := *raftID
+		if id == "" {
+			id = *raftAddr
+		}
+		if raftNode, err = openRaft(id, *raftAddr, *raftDir,
+			*raftPeers); err != nil {
+			log.Fatal(err)
+		}
+		outbound, rereads, writes, flocks = true, true, true, true
+	}
+
+	if *boltFile != "" {
+		bs, err := openBoltStore(*boltFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store, flocks = bs, true
+	}
+
+	if *redisAddr != "" {
+		var password string
+		if *redisPasswordFile != "" {
+			b, err := ioutil.ReadFile(*redisPasswordFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			password = strings.TrimSpace(string(b))
+		}
+		rs := newRedisStore(*redisAddr, password)
+		store, outbound = rs, true
+
+		if *clustered {
+			cluster = rs
+		}
+	} else if *clustered {
+		log.Fatal("-cluster needs -redis")
+	}
+
+	if *postgresDSN != "" {
+		ps, err := openPGStore(*postgresDSN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// New connections may read ~/.pgpass and TLS files.
+		store, outbound, rereads = ps, true, true
+	}
+
+	lock.Lock()
+	mounted = true
+	err = loadRooms()
+	lock.Unlock()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if archiveDir != "" {
+		if err := os.MkdirAll(archiveDir, 0700); err != nil {
+			log.Fatal(err)
+		}
+		writes, rereads = true, true
+		go logDays()
+	}
+
+	if *s3Endpoint != "" {
+		if *s3Bucket == "" || *s3KeyID == "" || *s3SecretFile == "" {
+			log.Fatal("-s3-endpoint needs -s3-bucket, " +
+				"-s3-access-key-id and -s3-secret-file")
+		}
+		b, err := ioutil.ReadFile(*s3SecretFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if archiveS3, err = newS3Bucket(*s3Endpoint, *s3Bucket, *s3Region,
+			*s3KeyID, strings.TrimSpace(string(b))); err != nil {
+			log.Fatal(err)
+		}
+		outbound = true
+	}
+
+	// The new process starts from the rooms saved for it.
+	if upgrades && *snapshotFile == "" {
+		log.Fatal("-upgrades needs -snapshot")
+	}
+
+	if *snapshotFile != "" {
+		if err := loadSnapshot(*snapshotFile); err != nil {
+			log.Fatal(err)
+		}
+		writes = true
+
+		if *snapshotInterval > 0 {
+			go autosave(*snapshotFile, *snapshotInterval)
+		}
+	}
+
+	mux := routes()
+
+	var sd *statsd
+	if *statsdAddr != "" {
+		if sd, err = newStatsd(*statsdAddr, *statsdPrefix,
+			*statsdTags); err != nil {
+			log.Fatal(err)
+		}
+		go sd.run(10 * time.Second)
+	}
+
+	// Only the headers are given a deadline, as polls and streams hold
+	// requests open for long.
+	srv := &http.Server{
+		Addr:              ":8444",
+		Handler:           timeRequests(sd, compress(mux)),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	var cr *certReloader
+	if *tlsCert != "" || *tlsKey != "" {
+		if cr, err = newCertReloader(*tlsCert, *tlsKey); err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = tlsConfig(cr.getCertificate)
+		rereads = true
+		go cr.watch()
+	}
+
+	var acme *autocert.Manager
+	if *acmeHosts != "" {
+		if cr != nil {
+			log.Fatal("-acme-host conflicts with -tls-cert")
+		}
+		if acme, err = acmeManager(strings.Split(*acmeHosts, ","),
+			*acmeDir); err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = acmeTLSConfig(acme)
+		outbound, rereads, writes = true, true, true
+	}
+
+	if *listenAddr != "" {
+		srv.Addr = *listenAddr
+	}
+
+	mode, err := strconv.ParseUint(*listenMode, 8, 32)
+	if err != nil {
+		log.Fatalf("-listen-mode: %v", err)
+	}
+	socketMode = os.FileMode(mode)
+
+	if dev {
+		hsts = ""
+
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		if *listenAddr == "" {
+			srv.Addr = "localhost:8444"
+		}
+		srv.Handler = logRequests(srv.Handler)
+	}
+
+	// lns are all the listeners for the sandbox to confine, starting
+	// with those passed by systemd, or else opened on -listen, which
+	// are served by srv as httpLns.
+	// Found now, as the sandbox may hide it later.
+	var exe string
+	if upgrades {
+		if exe, err = os.Executable(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err = inherit(); err != nil {
+		log.Fatal(err)
+	}
+	lns, err := activated()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(lns) == 0 {
+		for _, addr := range strings.Split(srv.Addr, ",") {
+			ln, err := openListener(strings.TrimSpace(addr))
+			if err != nil {
+				log.Fatal(err)
+			}
+			lns = append(lns, ln)
+		}
+	}
+
+	var httpLns []net.Listener
+	for _, ln := range lns {
+		if *proxyProtocol {
+			ln = proxyListener{ln}
+		}
+		httpLns = append(httpLns, ln)
+	}
+
+	if dev {
+		scheme := "http"
+		if srv.TLSConfig != nil {
+			scheme = "https"
+		}
+		for _, ln := range lns {
+			log.Printf("dev mode: serving %s on %s %s", scheme,
+				ln.Addr().Network(), ln.Addr())
+		}
+	}
+
+	if acme != nil {
+		port := ""
+		for _, ln := range httpLns {
+			if a, ok := ln.Addr().(*net.TCPAddr); ok {
+				port = strconv.Itoa(a.Port)
+				break
+			}
+		}
+		if port == "" {
+			log.Fatal("-acme-host needs a TCP -listen address")
+		}
+
+		aln, err := openListener(*acmeHTTP)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lns = append(lns, aln)
+
+		go func() {
+			log.Println(http.Serve(aln,
+				acme.HTTPHandler(httpsRedirect(port))))
+		}()
+	}
+
+	var h3 *http3.Server
+	if http3Addr != "" {
+		if srv.TLSConfig == nil {
+			log.Fatal("-http3 needs -tls-cert and -tls-key, " +
+				"or -acme-host")
+		}
+
+		pc, err := openPacketConn(http3Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		datagrams = true
+
+		h3 = newHTTP3(srv.Handler, srv.TLSConfig)
+		srv.Handler = altSvc(pc, srv.Handler)
+
+		go func() {
+			if err := h3.Serve(pc); err != nil &&
+				err != http.ErrServerClosed {
+				log.Println(err)
+			}
+		}()
+	}
+
+	if gopherAddr != "" {
+		gln, err := openListener(gopherAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lns = append(lns, gln)
+
+		go serve(gln, func(c net.Conn) {
+			gopher(c, gopherHost)
+		})
+	}
+
+	if lineAddr != "" {
+		lln, err := openListener(lineAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lns = append(lns, lln)
+
+		go serve(lln, lineConn)
+	}
+
+	if nntpAddr != "" {
+		nln, err := openListener(nntpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lns = append(lns, nln)
+
+		go serve(nln, nntpConn)
+	}
+
+	if smtpAddr != "" {
+		mln, err := openListener(smtpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lns = append(lns, mln)
+
+		go serve(mln, smtpConn)
+	}
+
+	if geminiAddr != "" {
+		if srv.TLSConfig == nil {
+			log.Fatal("-gemini needs -tls-cert and -tls-key, " +
+				"or -acme-host")
+		}
+
+		gln, err := openListener(geminiAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lns = append(lns, gln)
+
+		go serve(tls.NewListener(gln,
+			tlsConfig(srv.TLSConfig.GetCertificate)), gemini)
+	}
+
+	if ircAddr != "" {
+		iln, err := openListener(ircAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lns = append(lns, iln)
+
+		go serve(iln, ircConn)
+	}
+
+	if sshAddr != "" {
+		config, err := sshConfig(sshKey, sshAuthorizedKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sln, err := openListener(sshAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lns = append(lns, sln)
+
+		go serve(sln, func(c net.Conn) {
+			sshConn(c, config)
+		})
+	}
+
+	var gs *grpc.Server
+	if grpcAddr != "" {
+		gln, err := openListener(grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lns = append(lns, gln)
+
+		gs = newGRPC()
+		go func() {
+			if err := gs.Serve(gln); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	if !dev && !*noSandbox {
+		if err := sandbox(lns...); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if upgrades {
+		go upgradeOnSignal(exe, func() error {
+			return saveSnapshot(*snapshotFile)
+		})
+	}
+
+	go pruneLoop()
+
+	if cluster != nil {
+		go clusterLoop()
+		go publishLoop()
+	}
+
+	startDiscord()
+
+	if ircRelayURL != "" {
+		go ircRelayLoop()
+	}
+
+	srv.RegisterOnShutdown(func() {
+		// Streaming sessions tell their clients, as the notice is not
+		// a msg.
+		close(shutdown)
+
+		if gs != nil {
+			gs.GracefulStop()
+		}
+
+		if h3 != nil {
+			if err := h3.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+	})
+
+	// Shutting srv down closes every listener it serves.
+	ready()
+
+	secure := srv.TLSConfig != nil
+	graceful.Graceful(srv, func() {
+		for _, ln := range httpLns[1:] {
+			go serveHTTP(srv, ln, secure)
+		}
+		serveHTTP(srv, httpLns[0], secure)
+	}, os.Interrupt)
+
+	// Give streaming sessions a moment to deliver the shutdown notice.
+	done := make(chan struct{})
+	go func() {
+		streams.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+	}
+
+	// The new process saves its own rooms, so they are not overwritten.
+	if *snapshotFile != "" && atomic.LoadUint32(&upgraded) == 0 {
+		if err := saveSnapshot(*snapshotFile); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if raftNode != nil {
+		if err := raftNode.Shutdown().Error(); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if c, ok := store.(io.Closer); ok {
+		lock.Lock()
+		if err := c.Close(); err != nil {
+			log.Println(err)
+		}
+		lock.Unlock()
+	}
 }
@@ -0,0 +1,301 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/esote/chat/client"
+)
+
+// commands are the subcommands besides "serve", which is the default. The
+// admin ones act on a running server through /admin.
+var commands = map[string]func(args []string) error{
+	"client": clientMain,
+	"export": exportMain,
+	"import": importMain,
+	"prune":  pruneMain,
+	"purge":  purgeMain,
+	"stats":  statsMain,
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "usage: chat [serve] [flags]")
+	fmt.Fprintln(out, "       chat client url room")
+	fmt.Fprintln(out, "       chat export|import|prune|purge|stats "+
+		"[flags] (see chat cmd -h)")
+	flag.PrintDefaults()
+}
+
+// adminCmd holds the flags shared by subcommands that talk to /admin.
+type adminCmd struct {
+	fs        *flag.FlagSet
+	url       string
+	tokenFile string
+}
+
+func newAdminCmd(name, usage string) *adminCmd {
+	ac := &adminCmd{fs: flag.NewFlagSet(name, flag.ExitOnError)}
+	ac.fs.StringVar(&ac.url, "url", "http://localhost:8444", "server URL")
+	ac.fs.StringVar(&ac.tokenFile, "admin-token-file", "", "file holding "+
+		"the server's admin token")
+	ac.fs.Usage = func() {
+		fmt.Fprintln(ac.fs.Output(), "usage: chat "+name+" "+usage)
+		ac.fs.PrintDefaults()
+	}
+	return ac
+}
+
+// do sends body to /admin/op and returns the reply.
+func (ac *adminCmd) do(method, op, ctype string, body io.Reader) ([]byte,
+	error) {
+	if ac.tokenFile == "" {
+		return nil, errors.New("-admin-token-file is required")
+	}
+
+	b, err := ioutil.ReadFile(ac.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method,
+		strings.TrimSuffix(ac.url, "/")+"/admin/"+op, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+
+		strings.TrimSpace(string(b)))
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status,
+			bytes.TrimSpace(reply))
+	}
+
+	return reply, nil
+}
+
+// exportMain writes a JSON snapshot of the rooms, or of one room, which
+// importMain can load into a server.
+func exportMain(args []string) error {
+	ac := newAdminCmd("export", "[-room name]")
+	room := ac.fs.String("room", "", "only export this room")
+	_ = ac.fs.Parse(args)
+
+	b, err := ac.do("GET", "state", "", nil)
+	if err != nil {
+		return err
+	}
+
+	var state map[string]roomState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+
+	if *room != "" {
+		rs, ok := state[*room]
+		if !ok {
+			return errors.New("no such room: " + *room)
+		}
+		state = map[string]roomState{*room: rs}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(state)
+}
+
+// importMain loads a snapshot written by exportMain, replacing the rooms in
+// it, or with -room a transcript as served by /name/transcript, replacing
+// that room. The file "-" is stdin.
+func importMain(args []string) error {
+	ac := newAdminCmd("import", "[-room name] file")
+	room := ac.fs.String("room", "", "load file as a plain text "+
+		"transcript into this room")
+	_ = ac.fs.Parse(args)
+
+	if ac.fs.NArg() != 1 {
+		ac.fs.Usage()
+		os.Exit(2)
+	}
+
+	in := os.Stdin
+	if name := ac.fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var body io.Reader = in
+	if *room != "" {
+		rs, err := parseTranscript(in)
+		if err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(map[string]roomState{*room: rs})
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	b, err := ac.do("POST", "import", "application/json", body)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+// parseTranscript reads "2006-01-02 15:04: text" lines, oldest first, into
+// a room. Other lines, like notices, are skipped, and only the newest
+// maxMsgsCount msgs are kept.
+func parseTranscript(r io.Reader) (roomState, error) {
+	var rs roomState
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			continue
+		}
+
+		at, err := time.Parse("2006-01-02 15:04", line[:i])
+		if err != nil {
+			continue
+		}
+
+		rs.Seq++
+		rs.Last = at
+		rs.Msgs = append([]msgState{{
+			S:   html.EscapeString(line[i+2:]),
+			At:  at,
+			Seq: rs.Seq,
+		}}, rs.Msgs...)
+	}
+	if err := sc.Err(); err != nil {
+		return rs, err
+	}
+
+	if len(rs.Msgs) == 0 {
+		return rs, errors.New("no msgs in transcript")
+	} else if len(rs.Msgs) > maxMsgsCount {
+		rs.Msgs = rs.Msgs[:maxMsgsCount]
+	}
+
+	return rs, nil
+}
+
+// pruneMain deletes rooms idle for longer than -older-than.
+func pruneMain(args []string) error {
+	ac := newAdminCmd("prune", "-older-than duration")
+	olderThan := ac.fs.Duration("older-than", lifespan, "delete rooms "+
+		"with no msgs for this long")
+	_ = ac.fs.Parse(args)
+
+	form := url.Values{"older-than": {olderThan.String()}}
+	b, err := ac.do("POST", "prune", "application/x-www-form-urlencoded",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+// purgeMain deletes a room, or all rooms idle for -older-than, at once and
+// without archiving them.
+func purgeMain(args []string) error {
+	ac := newAdminCmd("purge", "-room name | -all [-older-than duration]")
+	room := ac.fs.String("room", "", "room to delete")
+	all := ac.fs.Bool("all", false, "delete every room idle for "+
+		"-older-than")
+	olderThan := ac.fs.Duration("older-than", 0, "with -all, only "+
+		"delete rooms with no msgs for this long")
+	_ = ac.fs.Parse(args)
+
+	form := url.Values{}
+	switch {
+	case *room != "" && !*all:
+		form.Set("room", *room)
+	case *all && *room == "":
+		form.Set("all", "1")
+		form.Set("older-than", olderThan.String())
+	default:
+		ac.fs.Usage()
+		os.Exit(2)
+	}
+
+	b, err := ac.do("POST", "purge", "application/x-www-form-urlencoded",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+// statsMain lists the rooms of a server with their msg counts.
+func statsMain(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	base := fs.String("url", "http://localhost:8444", "server URL")
+	_ = fs.Parse(args)
+
+	list, err := client.New(*base).ListRooms(context.Background())
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROOM\tMSGS\tLAST")
+
+	var total uint64
+	for _, rm := range list {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", rm.Name, rm.Seq,
+			rm.Last.Format(time.RFC3339))
+		total += rm.Seq
+	}
+	fmt.Fprintf(tw, "%d rooms\t%d\t\n", len(list), total)
+
+	return tw.Flush()
+}
@@ -0,0 +1,220 @@
+// Package client talks to a chat server over its JSON API.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrHeld is returned by Post when the msg is held for moderation.
+	ErrHeld = errors.New("chat: message held for moderation")
+
+	// ErrExpired is returned by Subscribe when the room expires.
+	ErrExpired = errors.New("chat: room expired")
+
+	// ErrClosed is returned by Subscribe when the server ends the stream,
+	// e.g. because it is restarting.
+	ErrClosed = errors.New("chat: stream closed")
+)
+
+// Error is an error reply from the server.
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("chat: %d %s", e.Code, e.Msg)
+}
+
+// Room is a room on the server.
+type Room struct {
+	Name string    `json:"name"`
+	Last time.Time `json:"last"`
+	Seq  uint64    `json:"seq"`
+}
+
+// Message is a msg in a room. Seq increases by one with each msg.
+type Message struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// Client is a client of the server at a base URL such as
+// "https://chat.example.com".
+type Client struct {
+	base string
+
+	// HTTPClient is used for requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// New returns a client of the server at base.
+func New(base string) *Client {
+	return &Client{base: strings.TrimSuffix(base, "/")}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body,
+	v interface{}) (int, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, &buf)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return resp.StatusCode, &Error{resp.StatusCode, e.Error}
+	}
+
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// ListRooms lists the rooms by name.
+func (c *Client) ListRooms(ctx context.Context) ([]Room, error) {
+	var rooms []Room
+	_, err := c.do(ctx, "GET", "/api/v1/rooms", nil, &rooms)
+	return rooms, err
+}
+
+// Messages lists the msgs of the room, oldest first.
+func (c *Client) Messages(ctx context.Context, room string) ([]Message,
+	error) {
+	return c.MessagesAfter(ctx, room, 0)
+}
+
+// MessagesAfter lists the msgs of the room with Seq greater than seq, oldest
+// first.
+func (c *Client) MessagesAfter(ctx context.Context, room string,
+	seq uint64) ([]Message, error) {
+	path := "/api/v1/rooms/" + url.PathEscape(room) + "/messages"
+	if seq != 0 {
+		path += "?after=" + strconv.FormatUint(seq, 10)
+	}
+
+	var msgs []Message
+	_, err := c.do(ctx, "GET", path, nil, &msgs)
+	return msgs, err
+}
+
+// Post posts msg to the room, creating it if needed, and returns the Seq of
+// the msg.
+func (c *Client) Post(ctx context.Context, room, msg string) (uint64,
+	error) {
+	var resp struct {
+		Seq uint64 `json:"seq"`
+	}
+
+	code, err := c.do(ctx, "POST",
+		"/api/v1/rooms/"+url.PathEscape(room)+"/messages",
+		map[string]string{"msg": msg}, &resp)
+	if err != nil {
+		return 0, err
+	} else if code == http.StatusAccepted {
+		return 0, ErrHeld
+	}
+	return resp.Seq, nil
+}
+
+// Subscribe calls f with each msg of the room with Seq greater than after, as
+// they arrive, until ctx is done or the stream ends. To resume, call it again
+// with the Seq of the last msg seen.
+func (c *Client) Subscribe(ctx context.Context, room string, after uint64,
+	f func(Message)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		c.base+"/events/"+url.PathEscape(room), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(after, 10))
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &Error{resp.StatusCode, http.StatusText(resp.StatusCode)}
+	}
+
+	// Events only announce new msgs; they are fetched from the API, which
+	// has them in full.
+	var event string
+	var id uint64
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			id, _ = strconv.ParseUint(strings.TrimPrefix(line, "id: "),
+				10, 64)
+		case line == "":
+			if event == "expired" {
+				return ErrExpired
+			}
+			if id > after {
+				msgs, err := c.MessagesAfter(ctx, room, after)
+				if err != nil {
+					return err
+				}
+				for _, m := range msgs {
+					f(m)
+					after = m.Seq
+				}
+			}
+			event, id = "", 0
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	} else if err := sc.Err(); err != nil {
+		return err
+	}
+	return ErrClosed
+}
@@ -0,0 +1,244 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// redisMsgs is the pub/sub channel new msgs are published to, and
+	// redisSeq+name counts each room's msgs, so seqs agree across
+	// instances and clients may poll any of them.
+	redisMsgs = "chat:msgs"
+	redisSeq  = "chat:seq:"
+
+	// publishQueue is how many msgs may wait to be published before new
+	// ones are dropped, so a slow Redis cannot hold up posting.
+	publishQueue = 256
+)
+
+// cluster shares new msgs and purges with the other instances using the same
+// Redis, so instances behind a load balancer serve one conversation per room.
+// It is nil unless clustering is enabled.
+//
+// Renames, merges and moderation state stay with the instance they happened
+// on.
+var cluster *redisStore
+
+// publishing holds new msgs and purges until publishLoop sends them.
+var publishing = make(chan clusterMsg, publishQueue)
+
+// instance tells this instance's own msgs apart when they come back.
+var instance = func() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}()
+
+// clusterMsg is a msg posted to the room, or with Purge set, the purge of
+// the room.
+type clusterMsg struct {
+	From  string  `json:"from"`
+	Room  string  `json:"room"`
+	ID    string  `json:"id"`
+	Msg   Message `json:"msg"`
+	Purge bool    `json:"purge,omitempty"`
+}
+
+// nextSeq returns the seq of the next msg in the room, whose latest is seq.
+// With Redis down, the local seq is used instead.
+func nextSeq(name string, seq uint64) uint64 {
+	if cluster == nil {
+		return seq + 1
+	}
+
+	key := redisSeq + name
+	ttl := strconv.Itoa(int(lifespan.Seconds()))
+
+	replies, err := cluster.do(
+		[]string{"INCR", key},
+		[]string{"EXPIRE", key, ttl},
+	)
+	if err != nil {
+		log.Printf("cluster: seq for %s: %v", name, err)
+		return seq + 1
+	}
+	n, _ := replies[0].(int64)
+
+	// The counter starts behind rooms loaded before it existed or
+	// outliving it.
+	if uint64(n) <= seq {
+		inc := strconv.FormatUint(seq+1-uint64(n), 10)
+		if replies, err = cluster.do(
+			[]string{"INCRBY", key, inc}); err != nil {
+			log.Printf("cluster: seq for %s: %v", name, err)
+			return seq + 1
+		}
+		n, _ = replies[0].(int64)
+	}
+
+	return uint64(n)
+}
+
+func init() {
+	listen(func(e event) {
+		if e, ok := e.(msgPosted); ok {
+			publish(e.room, e.id, e.msg)
+		}
+	})
+}
+
+// publish queues a new msg for the other instances. It never blocks.
+func publish(name, id string, m Message) {
+	enqueue(clusterMsg{From: instance, Room: name, ID: id, Msg: m})
+}
+
+// publishPurge queues the purge of the room for the other instances. It
+// never blocks.
+func publishPurge(name string) {
+	enqueue(clusterMsg{From: instance, Room: name, Purge: true})
+}
+
+func enqueue(cm clusterMsg) {
+	if cluster == nil {
+		return
+	}
+
+	select {
+	case publishing <- cm:
+	default:
+		log.Printf("cluster: queue full, dropping msg to %s", cm.Room)
+	}
+}
+
+// publishLoop sends queued msgs to the other instances, in order.
+func publishLoop() {
+	for cm := range publishing {
+		b, err := json.Marshal(cm)
+		if err != nil {
+			log.Printf("cluster: publish to %s: %v", cm.Room, err)
+			continue
+		}
+
+		if _, err := cluster.do([]string{"PUBLISH", redisMsgs,
+			string(b)}); err != nil {
+			log.Printf("cluster: publish to %s: %v", cm.Room, err)
+		}
+	}
+}
+
+// clusterLoop applies msgs published by other instances, resubscribing
+// when the connection is lost.
+func clusterLoop() {
+	for {
+		if err := subscribe(); err != nil {
+			log.Printf("cluster: %v", err)
+		}
+		time.Sleep(redisRetry)
+	}
+}
+
+func subscribe() error {
+	rc, err := cluster.dial()
+	if err != nil {
+		return err
+	}
+	defer rc.c.Close()
+
+	if _, err := rc.do([]string{"SUBSCRIBE", redisMsgs}); err != nil {
+		return err
+	}
+	// Pushes may be far apart.
+	if err := rc.c.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	// Msgs published while unsubscribed were missed; catch up on them
+	// from the store.
+	resync()
+
+	for {
+		v, err := rc.reply()
+		if err != nil {
+			return err
+		}
+
+		push, _ := v.([]interface{})
+		if len(push) != 3 || push[0] != "message" {
+			continue
+		}
+		payload, _ := push[2].(string)
+
+		var cm clusterMsg
+		if err := json.Unmarshal([]byte(payload), &cm); err != nil {
+			log.Printf("cluster: %v", err)
+			continue
+		}
+		if cm.From == instance || cm.Room == "" ||
+			len(cm.Room) > maxNameLen || !validName.MatchString(cm.Room) {
+			continue
+		}
+
+		lock.Lock()
+		if cm.Purge {
+			purgeRoom(cm.Room)
+		} else {
+			applyMsg(cm.Room, cm.ID, cm.Msg)
+		}
+		lock.Unlock()
+	}
+}
+
+// resync applies msgs in the store missing from memory.
+func resync() {
+	names, err := cluster.ListRooms()
+	if err != nil {
+		log.Printf("cluster: resync: %v", err)
+		return
+	}
+
+	for _, name := range names {
+		msgs, err := cluster.Messages(name)
+		if err != nil {
+			log.Printf("cluster: resync: %v", err)
+			continue
+		}
+
+		lock.Lock()
+		// Oldest first, so each lands at the front.
+		for i := len(msgs) - 1; i >= 0; i-- {
+			applyMsg(name, "", msgs[i])
+		}
+		lock.Unlock()
+	}
+}
+
+// applyMsg adds a msg posted on another instance to the room, unless the
+// room already has it. It is not stored again.
+func applyMsg(name, id string, m Message) {
+	rm, ok := rooms[name]
+	if !ok {
+		if reserved[name] || len(rooms)+1 > maxRoomCount {
+			return
+		}
+		rm = newRoom(m.Time)
+		rooms[name] = rm
+	}
+
+	if !rm.add(m, fromPeer) {
+		return
+	}
+
+	if id != "" {
+		rm.stats.count(m.Time, id)
+		server.count(m.Time)
+	}
+
+	emit(roomsChanged{rooms: []string{name}})
+}
@@ -0,0 +1,8 @@
+// Command chat is a room-based chat server.
+package main
+
+import "github.com/esote/chat"
+
+func main() {
+	chat.Main()
+}
@@ -0,0 +1,189 @@
+package chat
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// encoder is a compressor, as both gzip and brotli provide.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// encoders pools the compressors of each content coding.
+var encoders = map[string]*sync.Pool{
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotli.DefaultCompression)
+	}},
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+// compress compresses responses of text types for clients accepting it,
+// with brotli for pages and scripts and gzip otherwise. Streams opt out by
+// sending Cache-Control: no-transform, as they would otherwise each hold a
+// compressor for as long as they last.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			br:             acceptsEncoding(r, "br"),
+			gzip:           acceptsEncoding(r, "gzip"),
+		}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptsEncoding reports whether r lists the content coding in
+// Accept-Encoding, without q=0.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, f := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(f, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), coding) {
+			continue
+		}
+		_, q, ok := strings.Cut(strings.ReplaceAll(params, " ", ""), "q=")
+		if !ok {
+			return true
+		}
+		v, err := strconv.ParseFloat(q, 64)
+		return err == nil && v > 0
+	}
+	return false
+}
+
+// compressible reports whether responses of the media type are worth
+// compressing.
+func compressible(contentType string) bool {
+	t, _, _ := strings.Cut(contentType, ";")
+	t = strings.TrimSpace(strings.ToLower(t))
+
+	switch t {
+	case "application/json", "application/javascript",
+		"application/atom+xml", "application/feed+json":
+		return true
+	}
+	return strings.HasPrefix(t, "text/")
+}
+
+// wantsBrotli reports whether responses of the media type are worth the
+// slower brotli: the pages and scripts, which its built-in dictionary of
+// web content suits best.
+func wantsBrotli(contentType string) bool {
+	t, _, _ := strings.Cut(contentType, ";")
+	t = strings.TrimSpace(strings.ToLower(t))
+
+	switch t {
+	case "text/html", "text/javascript", "application/javascript":
+		return true
+	}
+	return false
+}
+
+// compressWriter compresses the response, if compressible, once its headers
+// are known.
+type compressWriter struct {
+	http.ResponseWriter
+
+	br, gzip bool
+	decided  bool
+
+	coding string
+	enc    encoder
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if !cw.decided {
+		cw.decide(code)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) decide(code int) {
+	cw.decided = true
+
+	h := cw.Header()
+	if code < 200 || code == http.StatusNoContent ||
+		code == http.StatusPartialContent ||
+		code == http.StatusNotModified ||
+		h.Get("Content-Encoding") != "" ||
+		strings.Contains(h.Get("Cache-Control"), "no-transform") ||
+		!compressible(h.Get("Content-Type")) {
+		return
+	}
+
+	h.Add("Vary", "Accept-Encoding")
+	switch {
+	case cw.br && wantsBrotli(h.Get("Content-Type")):
+		cw.coding = "br"
+	case cw.gzip:
+		cw.coding = "gzip"
+	default:
+		return
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", cw.coding)
+	cw.enc = encoders[cw.coding].Get().(encoder)
+	cw.enc.Reset(cw.ResponseWriter)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets websockets take over the connection.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking unsupported")
+	}
+	return h.Hijack()
+}
+
+func (cw *compressWriter) close() {
+	if cw.enc == nil {
+		return
+	}
+	_ = cw.enc.Close()
+	cw.enc.Reset(nil)
+	encoders[cw.coding].Put(cw.enc)
+}
@@ -0,0 +1,178 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// dayFormat names the day logs of each room, archiveDir/room/day.jsonl,
+	// each holding the msgs posted that day (UTC) as lines of JSON, oldest
+	// first.
+	dayFormat = "2006-01-02"
+
+	// dayLogQueue is how many msgs may wait to be logged before new ones
+	// are dropped, so a slow disk cannot hold up posting.
+	dayLogQueue = 256
+)
+
+// dayMsg is a msg waiting to be logged.
+type dayMsg struct {
+	room string
+	msg  Message
+}
+
+// dayLogs holds new msgs until logDays writes them.
+var dayLogs = make(chan dayMsg, dayLogQueue)
+
+func init() {
+	listen(func(e event) {
+		if e, ok := e.(msgPosted); ok && archiveDir != "" {
+			queueDay(e.room, e.msg)
+		}
+	})
+}
+
+// queueDay queues a new msg for its day log. It never blocks.
+func queueDay(name string, m Message) {
+	select {
+	case dayLogs <- dayMsg{room: name, msg: m}:
+	default:
+		log.Printf("archive: queue full, dropping msg to %s", name)
+	}
+}
+
+// logDays appends queued msgs to the day logs of their rooms, so rooms are
+// archived while active too.
+func logDays() {
+	for dm := range dayLogs {
+		if err := logDay(dm.room, dm.msg); err != nil {
+			log.Printf("archive: %v", err)
+		}
+	}
+}
+
+func logDay(name string, m Message) error {
+	b, err := json.Marshal(msgState{S: m.HTML, At: m.Time, Seq: m.Seq})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(archiveDir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir,
+		m.Time.UTC().Format(dayFormat)+".jsonl"),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// days serves the day logs of the room read-only: /name/archive lists the
+// days msgs were posted, and /name/archive/day shows those posted that day,
+// like the log viewers of IRC channels.
+func days(name, sub string, w http.ResponseWriter, r *http.Request) {
+	if archiveDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+		return
+	}
+
+	setCSP(w, "default-src 'none';")
+
+	if day := strings.TrimPrefix(sub, "archive/"); day != sub {
+		dayLog(name, day, w, r)
+	} else {
+		dayIndex(name, w, r)
+	}
+}
+
+func dayIndex(name string, w http.ResponseWriter, r *http.Request) {
+	infos, err := ioutil.ReadDir(filepath.Join(archiveDir, name))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "archive unavailable",
+			http.StatusInternalServerError)
+		return
+	}
+
+	// Newest first, like rooms.
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() > infos[j].Name()
+	})
+
+	fmt.Fprintf(w, archivePageStart, name, name, prefix+"/"+name)
+	for _, fi := range infos {
+		t, err := time.Parse(dayFormat,
+			strings.TrimSuffix(fi.Name(), ".jsonl"))
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, `
+	<p><a href="%s/%s/archive/%s">%s &gt;</a></p>`, prefix, name,
+			t.Format(dayFormat), t.Format(dayFormat))
+	}
+	fmt.Fprint(w, archivePageEnd)
+}
+
+func dayLog(name, day string, w http.ResponseWriter, r *http.Request) {
+	t, err := time.Parse(dayFormat, day)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(archiveDir, name,
+		t.Format(dayFormat)+".jsonl"))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "archive unavailable",
+			http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintf(w, archivePageStart, name+" "+t.Format(dayFormat),
+		name, prefix+"/"+name+"/archive")
+	fmt.Fprintf(w, `
+	<p>%s, read-only (time in UTC):</p><pre>`, t.Format(dayFormat))
+
+	// A line cut short by a crash is skipped.
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var m msgState
+		if json.Unmarshal(sc.Bytes(), &m) == nil {
+			printMsg(w, msg{s: m.S, t: m.At.Format("15:04")})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		log.Printf("archive: %v", err)
+	}
+	fmt.Fprint(w, "</pre>"+archivePageEnd)
+}
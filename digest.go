@@ -0,0 +1,373 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	digestInterval = 24 * time.Hour
+
+	// maxDigestSubs bounds the subscriptions to each room.
+	maxDigestSubs = 100
+)
+
+var (
+	// digestSMTP is the mail server digests are sent through, as
+	// host:port. Digests are disabled if empty.
+	digestSMTP     string
+	digestFrom     string
+	digestUser     string
+	digestPassword string
+
+	// digestFile keeps the subscriptions across restarts.
+	digestFile string
+
+	// digestLimit bounds how often each client may ask for a digest, as
+	// each sends a mail.
+	digestLimit = newLimiter(1.0/60, 3)
+
+	// digests is guarded by the global lock.
+	digests digestState
+)
+
+type digestState struct {
+	// Key signs the links in mails.
+	Key []byte `json:"key"`
+
+	// Subs are the confirmed subscriptions, by room and address.
+	Subs map[string]map[string]*digestSub `json:"subs"`
+}
+
+type digestSub struct {
+	// Base is the server's URL as the subscriber saw it, for links.
+	Base string `json:"base"`
+
+	// Last is when the newest msg sent was posted.
+	Last time.Time `json:"last"`
+}
+
+const (
+	digestForm = `
+	<form action="%s/%s/digest" method="post">
+		<label>daily digest: </label>
+		<input type="email" name="email" required placeholder="email">
+		<input type="submit" value="subscribe">
+	</form>`
+
+	digestConfirm = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport"
+		content="width=device-width, initial-scale=1, shrink-to-fit=no">
+	<title>Digest: %s</title>
+</head>
+<body>
+	<p>%s daily digest of room %s for %s?</p>
+	<form method="post">
+		<input type="hidden" name="op" value="%s">
+		<input type="hidden" name="email" value="%s">
+		<input type="hidden" name="sig" value="%s">
+		<input type="submit" value="%s">
+	</form>
+</body>
+</html>`
+)
+
+// loadDigests reads the subscriptions from digestFile, starting afresh if it
+// does not exist.
+func loadDigests() error {
+	b, err := ioutil.ReadFile(digestFile)
+	if os.IsNotExist(err) {
+		digests.Key = make([]byte, 32)
+		if _, err := rand.Read(digests.Key); err != nil {
+			return err
+		}
+		digests.Subs = make(map[string]map[string]*digestSub)
+		return saveDigests()
+	} else if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, &digests); err != nil {
+		return fmt.Errorf("%s: %w", digestFile, err)
+	}
+	if digests.Subs == nil {
+		digests.Subs = make(map[string]map[string]*digestSub)
+	}
+	return nil
+}
+
+// saveDigests writes the subscriptions to digestFile. The global lock must be
+// held, except on startup.
+func saveDigests() error {
+	b, err := json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+	return writeFile(digestFile, b)
+}
+
+// digestSig signs op (subscribe or unsubscribe) for addr in the room.
+func digestSig(op, name, addr string) string {
+	mac := hmac.New(sha256.New, digests.Key)
+	fmt.Fprintf(mac, "%s\n%s\n%s", op, name, addr)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func digestLink(base, op, name, addr string) string {
+	return base + "/" + name + "/digest?" + url.Values{
+		"op":    {op},
+		"email": {addr},
+		"sig":   {digestSig(op, name, addr)},
+	}.Encode()
+}
+
+func printDigestForm(name string, w io.Writer) {
+	if digestSMTP != "" {
+		fmt.Fprintf(w, digestForm, prefix, name)
+	}
+}
+
+// digest serves /name/digest. Posting an address mails it a link to confirm
+// the subscription. Signed links, from that mail or a digest, show a form to
+// confirm or unsubscribe, which posts back here. One-click unsubscribes from
+// mail clients post directly.
+func digest(name string, w http.ResponseWriter, r *http.Request) {
+	if digestSMTP == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	setCSP(w, "default-src 'none';")
+
+	op, addr := r.FormValue("op"), r.FormValue("email")
+
+	if op == "" {
+		if r.Method != "POST" {
+			http.Error(w, "bad http verb",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		digestRequest(name, addr, w, r)
+		return
+	}
+
+	if op != "subscribe" && op != "unsubscribe" ||
+		!hmac.Equal([]byte(r.FormValue("sig")),
+			[]byte(digestSig(op, name, addr))) {
+		http.Error(w, "bad link", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		// Following a link only asks, so link scanners in mail do not
+		// act on it.
+		verb := "Subscribe to the"
+		if op == "unsubscribe" {
+			verb = "Unsubscribe from the"
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, digestConfirm, name, verb, name,
+			html.EscapeString(addr), op, html.EscapeString(addr),
+			r.FormValue("sig"), op)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	subs := digests.Subs[name]
+
+	if op == "unsubscribe" {
+		if _, ok := subs[addr]; ok {
+			delete(subs, addr)
+			if len(subs) == 0 {
+				delete(digests.Subs, name)
+			}
+			if err := saveDigests(); err != nil {
+				log.Printf("digest: %v", err)
+			}
+		}
+		fmt.Fprintf(w, "unsubscribed %s from %s\n", addr, name)
+		return
+	}
+
+	if _, ok := rooms[name]; !ok {
+		http.Error(w, "room expired", http.StatusNotFound)
+		return
+	}
+
+	if _, ok := subs[addr]; !ok {
+		if len(subs) >= maxDigestSubs {
+			http.Error(w, "too many subscribers",
+				http.StatusConflict)
+			return
+		}
+		if subs == nil {
+			subs = make(map[string]*digestSub)
+			digests.Subs[name] = subs
+		}
+		subs[addr] = &digestSub{
+			Base: baseURL(r),
+			Last: time.Now().UTC(),
+		}
+		if err := saveDigests(); err != nil {
+			log.Printf("digest: %v", err)
+		}
+	}
+
+	fmt.Fprintf(w, "subscribed %s to %s\n", addr, name)
+}
+
+// digestRequest mails addr a link to confirm its subscription to the room.
+func digestRequest(name, addr string, w http.ResponseWriter, r *http.Request) {
+	if _, ok := rooms[name]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	a, err := mail.ParseAddress(addr)
+	if err != nil || strings.ContainsAny(a.Address, "\r\n") {
+		http.Error(w, "bad email", http.StatusBadRequest)
+		return
+	}
+	addr = a.Address
+
+	if !limit(digestLimit, w, r) {
+		return
+	}
+
+	body := fmt.Sprintf("Someone, hopefully you, asked for a daily "+
+		"digest of room %s at %s.\n\nTo confirm, open:\n%s\n\n"+
+		"Otherwise, ignore this mail.\n", name, baseURL(r),
+		digestLink(baseURL(r), "subscribe", name, addr))
+	go sendDigestMail(addr, "Confirm digest of "+name, body, "")
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "sent a confirmation link to %s\n", addr)
+}
+
+func init() {
+	listen(func(e event) {
+		// Rooms are pruned with the global lock held for writing,
+		// as digests need. Purged rooms get no last digest.
+		if e, ok := e.(roomsPruned); ok && !e.purged {
+			for i, name := range e.rooms {
+				digestPruned(name, e.rms[i])
+			}
+		}
+	})
+}
+
+// digestLoop sends digests every digestInterval.
+func digestLoop() {
+	for range time.Tick(digestInterval) {
+		lock.Lock()
+		var names []string
+		for name := range digests.Subs {
+			names = append(names, name)
+		}
+		for _, name := range names {
+			if rm, ok := rooms[name]; ok {
+				sendDigests(name, rm)
+			} else {
+				delete(digests.Subs, name)
+			}
+		}
+		if err := saveDigests(); err != nil {
+			log.Printf("digest: %v", err)
+		}
+		lock.Unlock()
+	}
+}
+
+// digestPruned sends the last digests of a room pruned. The global lock must
+// be held.
+func digestPruned(name string, rm *room) {
+	if _, ok := digests.Subs[name]; !ok {
+		return
+	}
+
+	sendDigests(name, rm)
+	delete(digests.Subs, name)
+	if err := saveDigests(); err != nil {
+		log.Printf("digest: %v", err)
+	}
+}
+
+// sendDigests mails each subscriber to the room the msgs posted since their
+// last digest, if any, in the background. The global lock must be held.
+func sendDigests(name string, rm *room) {
+	for addr, sub := range digests.Subs[name] {
+		var b strings.Builder
+		last := sub.Last
+		for i := rm.msgs.Len() - 1; i >= 0; i-- {
+			if m := rm.msgs.At(i); m.at.After(sub.Last) {
+				fmt.Fprintln(&b, m)
+				last = m.at
+			}
+		}
+		if b.Len() == 0 {
+			continue
+		}
+		sub.Last = last
+
+		unsub := digestLink(sub.Base, "unsubscribe", name, addr)
+		fmt.Fprintf(&b, "\n-- \n%s/%s\nUnsubscribe: %s\n", sub.Base,
+			name, unsub)
+
+		go sendDigestMail(addr, "Digest of "+name, b.String(), unsub)
+	}
+}
+
+func sendDigestMail(to, subject, body, unsub string) {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", digestFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8",
+		subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if unsub != "" {
+		fmt.Fprintf(&msg, "List-Unsubscribe: <%s>\r\n", unsub)
+		fmt.Fprintf(&msg, "List-Unsubscribe-Post: "+
+			"List-Unsubscribe=One-Click\r\n")
+	}
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	_, _ = qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	_ = qp.Close()
+
+	var auth smtp.Auth
+	if digestUser != "" {
+		host, _, _ := net.SplitHostPort(digestSMTP)
+		auth = smtp.PlainAuth("", digestUser, digestPassword, host)
+	}
+
+	if err := smtp.SendMail(digestSMTP, auth, digestFrom, []string{to},
+		msg.Bytes()); err != nil {
+		log.Printf("digest: mail to %s: %v", to, err)
+	}
+}
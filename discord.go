@@ -0,0 +1,257 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	discordAPI = "https://discord.com/api/v10"
+
+	// discordPoll is how often each channel is polled for new messages.
+	discordPoll = 3 * time.Second
+)
+
+var (
+	// discordToken is the bot token the bridge acts as. The bot needs the
+	// Message Content intent to see what others post.
+	discordToken string
+
+	// discordChannels maps bridged rooms to Discord channel IDs.
+	discordChannels map[string]string
+)
+
+type discordMsg struct {
+	ID        string `json:"id"`
+	Content   string `json:"content"`
+	WebhookID string `json:"webhook_id"`
+	Author    struct {
+		ID  string `json:"id"`
+		Bot bool   `json:"bot"`
+	} `json:"author"`
+	Attachments []struct {
+		URL string `json:"url"`
+	} `json:"attachments"`
+}
+
+// parseDiscordChannels parses a comma-separated list of room=channel.
+func parseDiscordChannels(s string) (map[string]string, error) {
+	m := make(map[string]string)
+
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+
+		name, ch, ok := strings.Cut(f, "=")
+		if !ok || name == "" || len(name) > maxNameLen ||
+			!validName.MatchString(name) || reserved[name] {
+			return nil, fmt.Errorf("discord: bad room in %q", f)
+		}
+		if _, err := strconv.ParseUint(ch, 10, 64); err != nil {
+			return nil, fmt.Errorf("discord: bad channel in %q", f)
+		}
+
+		m[name] = ch
+	}
+
+	return m, nil
+}
+
+// discordCall calls the Discord API as the bot, decoding the response into
+// out if not nil. Rate limited calls are retried once, after the wait Discord
+// asks for.
+func discordCall(method, path string, in, out interface{}) error {
+	var b []byte
+	if in != nil {
+		var err error
+		if b, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	for try := 0; ; try++ {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			10*time.Second)
+
+		req, err := http.NewRequestWithContext(ctx, method,
+			discordAPI+path, bytes.NewReader(b))
+		if err != nil {
+			cancel()
+			return err
+		}
+		req.Header.Set("Authorization", "Bot "+discordToken)
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			cancel()
+			return err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && try == 0 {
+			var limited struct {
+				RetryAfter float64 `json:"retry_after"`
+			}
+			_ = json.NewDecoder(resp.Body).Decode(&limited)
+			resp.Body.Close()
+			cancel()
+
+			time.Sleep(time.Duration(limited.RetryAfter *
+				float64(time.Second)))
+			continue
+		}
+
+		if resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			cancel()
+			return fmt.Errorf("discord: %s %s: %s", method, path,
+				resp.Status)
+		}
+
+		if out != nil {
+			err = json.NewDecoder(resp.Body).Decode(out)
+		}
+		resp.Body.Close()
+		cancel()
+		return err
+	}
+}
+
+// startDiscord starts relaying each bridged room.
+func startDiscord() {
+	for name, ch := range discordChannels {
+		streams.Add(1)
+		go discordRelay(name, ch)
+	}
+}
+
+// discordRelay relays new msgs between the room and the Discord channel,
+// polling the channel, until shutdown. Only msgs posted after it started are
+// relayed either way. In a Raft cluster only the leader relays.
+func discordRelay(name, ch string) {
+	defer streams.Done()
+
+	var after string
+	var latest []discordMsg
+	if err := discordCall("GET", "/channels/"+ch+"/messages?limit=1", nil,
+		&latest); err != nil {
+		log.Println(err)
+	} else if len(latest) != 0 {
+		after = latest[0].ID
+	}
+
+	lock.Lock()
+	seen := seqOf(name)
+	lock.Unlock()
+
+	sub := watch(name)
+	defer sub.stop()
+
+	tick := time.NewTicker(discordPoll)
+	defer tick.Stop()
+
+	stopping, pull := false, true
+
+	for {
+		if pull && !raftFollower() {
+			after = discordPull(name, ch, after)
+		}
+
+		var bodies []string
+
+		if rm, ok := rlockRoom(name); ok {
+			for i := rm.msgs.Len() - 1; i >= 0; i-- {
+				m := rm.msgs.At(i)
+				if m.seq > seen && m.relayed("discord") {
+					bodies = append(bodies,
+						html.UnescapeString(m.s))
+				}
+			}
+			seen = rm.seq
+			rm.unlock()
+		} else {
+			// Pruned rooms start over.
+			seen = 0
+		}
+
+		for _, body := range bodies {
+			if err := discordCall("POST", "/channels/"+ch+"/messages",
+				map[string]interface{}{
+					"content": body,
+					// Msgs must not ping anyone.
+					"allowed_mentions": map[string][]string{
+						"parse": {},
+					},
+				}, nil); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if stopping {
+			return
+		}
+
+		pull = false
+		select {
+		case <-sub.c:
+		case <-tick.C:
+			pull = true
+		case <-shutdown:
+			stopping = true
+		}
+	}
+}
+
+// discordPull posts the messages in the channel after the message ID after
+// to the room, returning the ID of the last one seen. Messages from bots,
+// including the bridge itself, and from webhooks are skipped.
+func discordPull(name, ch, after string) string {
+	q := url.Values{"limit": {"50"}}
+	if after != "" {
+		q.Set("after", after)
+	}
+
+	var msgs []discordMsg
+	if err := discordCall("GET", "/channels/"+ch+"/messages?"+q.Encode(),
+		nil, &msgs); err != nil {
+		log.Println(err)
+		return after
+	}
+
+	// Newest first.
+	for i := len(msgs) - 1; i >= 0; i-- {
+		m := msgs[i]
+		after = m.ID
+
+		if m.Author.Bot || m.WebhookID != "" {
+			continue
+		}
+
+		body := m.Content
+		for _, a := range m.Attachments {
+			body += " " + a.URL
+		}
+		// Msgs are one line.
+		body = strings.Join(strings.Fields(body), " ")
+
+		_, err := addMsgFrom(name, body, clientID("discord:"+m.Author.ID),
+			"discord")
+		if err != nil && err != errHeld {
+			log.Printf("discord: %s: %v", name, err)
+		}
+	}
+
+	return after
+}
@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsblTimeout = 2 * time.Second
+	dnsblTTL     = time.Hour
+	dnsblMaxSize = 10000
+)
+
+var (
+	// dnsbls are the DNS blocklist zones posting clients are checked
+	// against, e.g. "dnsel.torproject.org".
+	dnsbls []string
+
+	// listedLimit applies to clients on any blocklist: one msg a minute.
+	listedLimit = newLimiter(1.0/60, 1)
+
+	dnsblCache = struct {
+		sync.Mutex
+		m map[string]dnsblEntry
+	}{m: make(map[string]dnsblEntry)}
+)
+
+type dnsblEntry struct {
+	listed  bool
+	expires time.Time
+}
+
+// dnsblName returns the name to look up for ip in zone: reversed octets for
+// IPv4, reversed nibbles for IPv6.
+func dnsblName(ip net.IP, zone string) string {
+	var b strings.Builder
+
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := 3; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip4[i])
+		}
+	} else {
+		for i := len(ip) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%x.%x.", ip[i]&0xf, ip[i]>>4)
+		}
+	}
+
+	b.WriteString(zone)
+	return b.String()
+}
+
+// listed reports whether host is on any configured blocklist. Results are
+// cached, and lookups that fail or time out count as not listed.
+func listed(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil || len(dnsbls) == 0 {
+		return false
+	}
+
+	now := time.Now()
+
+	dnsblCache.Lock()
+	e, ok := dnsblCache.m[host]
+	dnsblCache.Unlock()
+
+	if ok && now.Before(e.expires) {
+		return e.listed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsblTimeout)
+	defer cancel()
+
+	e = dnsblEntry{expires: now.Add(dnsblTTL)}
+
+	for _, zone := range dnsbls {
+		addrs, err := net.DefaultResolver.LookupHost(ctx,
+			dnsblName(ip, zone))
+		if err == nil && len(addrs) > 0 {
+			e.listed = true
+			break
+		}
+	}
+
+	dnsblCache.Lock()
+	if len(dnsblCache.m) >= dnsblMaxSize {
+		dnsblCache.m = make(map[string]dnsblEntry)
+	}
+	dnsblCache.m[host] = e
+	dnsblCache.Unlock()
+
+	return e.listed
+}
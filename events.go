@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keepalive is how often an idle event stream gets a comment, so proxies do
+// not time it out.
+const keepalive = 15 * time.Second
+
+// events serves /events/name as a text/event-stream of the room's msgs,
+// oldest first. Clients reconnecting with Last-Event-ID get only what they
+// missed.
+func events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/events/")
+	if name == "" || len(name) > maxNameLen || !validName.MatchString(name) {
+		http.Error(w, "bad name", http.StatusBadRequest)
+		return
+	}
+
+	securityHeaders(w)
+
+	if !limit(readLimit, w, r) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported",
+			http.StatusInternalServerError)
+		return
+	}
+
+	seen, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	lock.RLock()
+	name, _ = resolve(name)
+	_, ok = rooms[name]
+	lock.RUnlock()
+
+	if !ok {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+
+	streams.Add(1)
+	defer streams.Done()
+
+	sub := watch(name)
+	defer sub.stop()
+
+	setCSP(w, "default-src 'none';")
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-transform")
+
+	ticker := time.NewTicker(keepalive)
+	defer ticker.Stop()
+
+	stopping := false
+
+	for {
+		var b strings.Builder
+
+		lock.RLock()
+		rm, ok := rooms[name]
+		if !ok {
+			to, moved := resolve(name)
+			lock.RUnlock()
+			if !moved {
+				fmt.Fprint(w, "event: expired\n"+
+					"data: room expired\n\n")
+				return
+			}
+			name = to
+			sub.follow(to)
+			continue
+		}
+		rm.mu.Lock()
+		for i := rm.msgs.Len() - 1; i >= 0; i-- {
+			if m := rm.msgs.At(i); m.seq > seen {
+				fmt.Fprintf(&b, "id: %d\ndata: %s\n\n", m.seq, m)
+			}
+		}
+		seen = rm.seq
+		rm.unlock()
+
+		if _, err := fmt.Fprint(w, b.String()); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		// One last pass delivers msgs posted before shutdown, then the
+		// notice, which is not a msg and so has no id.
+		if stopping {
+			if noticeShutdown() {
+				fmt.Fprint(w, "event: notice\ndata: "+
+					shutdownNotice+"\n\n")
+			}
+			return
+		}
+
+		select {
+		case <-sub.c:
+		case <-r.Context().Done():
+			return
+		case <-shutdown:
+			stopping = true
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
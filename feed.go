@@ -0,0 +1,148 @@
+package chat
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"time"
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Content string   `xml:"content"`
+}
+
+type jsonFeed struct {
+	Version string     `json:"version"`
+	Title   string     `json:"title"`
+	Home    string     `json:"home_page_url"`
+	Feed    string     `json:"feed_url"`
+	Items   []jsonItem `json:"items"`
+}
+
+type jsonItem struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Text      string `json:"content_text"`
+	Published string `json:"date_published"`
+}
+
+// baseURL is the scheme, host and path prefix of the server r was made to.
+func baseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host + prefix
+	}
+	return "http://" + r.Host + prefix
+}
+
+// entryID is a stable tag URI (RFC 4151) for m in the room name.
+func entryID(r *http.Request, name string, m msg) string {
+	return fmt.Sprintf("tag:%s,%s:%s/%d.%d", r.Host,
+		m.at.Format("2006-01-02"), name, m.seq, m.at.UnixNano())
+}
+
+// atom serves the msgs of the room as an Atom feed, newest first.
+func atom(name string, w http.ResponseWriter, r *http.Request) {
+	rm, ok := rooms[name]
+	if !ok {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	base := baseURL(r)
+
+	feed := atomFeed{
+		Title:   "chat: " + name,
+		ID:      base + "/" + name,
+		Updated: rm.last.Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Href: base + "/" + name + "/feed.atom"},
+			{Href: base + "/" + name},
+		},
+		Author: atomAuthor{Name: "anon"},
+	}
+
+	for i := 0; i < rm.msgs.Len(); i++ {
+		m := rm.msgs.At(i)
+		text := html.UnescapeString(m.s)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   text,
+			ID:      entryID(r, name, m),
+			Updated: m.at.Format(time.RFC3339),
+			Link:    atomLink{Href: base + "/" + name},
+			Content: text,
+		})
+	}
+
+	setCSP(w, "default-src 'none';")
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	_ = enc.Encode(feed)
+}
+
+// jsonfeed serves the msgs of the room as a JSON Feed 1.1, newest first.
+func jsonfeed(name string, w http.ResponseWriter, r *http.Request) {
+	rm, ok := rooms[name]
+	if !ok {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	base := baseURL(r)
+
+	feed := jsonFeed{
+		Version: "https://jsonfeed.org/version/1.1",
+		Title:   "chat: " + name,
+		Home:    base + "/" + name,
+		Feed:    base + "/" + name + "/feed.json",
+		Items:   []jsonItem{},
+	}
+
+	for i := 0; i < rm.msgs.Len(); i++ {
+		m := rm.msgs.At(i)
+		feed.Items = append(feed.Items, jsonItem{
+			ID:        entryID(r, name, m),
+			URL:       base + "/" + name,
+			Text:      html.UnescapeString(m.s),
+			Published: m.at.Format(time.RFC3339),
+		})
+	}
+
+	setCSP(w, "default-src 'none';")
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	_ = enc.Encode(feed)
+}
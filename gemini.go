@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// gemini answers a single Gemini request over the TLS connection c. "/" lists
+// the rooms, "/name" is a room's history as gemtext, and "/name/post" asks
+// for a msg to post to it.
+func gemini(c net.Conn) {
+	defer c.Close()
+
+	if err := c.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return
+	}
+
+	line, err := bufio.NewReader(io.LimitReader(c, 1026)).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	var b bytes.Buffer
+	geminiServe(&b, strings.TrimRight(line, "\r\n"), remoteHost(c))
+	_, _ = b.WriteTo(c)
+}
+
+func geminiServe(b *bytes.Buffer, req, host string) {
+	u, err := url.Parse(req)
+	if err != nil || u.Scheme != "gemini" {
+		fmt.Fprint(b, "59 bad request\r\n")
+		return
+	}
+
+	path := strings.TrimPrefix(u.Path, "/")
+	name, sub, _ := strings.Cut(path, "/")
+
+	if name != "" && (len(name) > maxNameLen ||
+		!foldName.MatchString(name)) {
+		fmt.Fprint(b, "51 no such room\r\n")
+		return
+	}
+	name = strings.ToLower(name)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	switch {
+	case name == "" && sub == "":
+		fmt.Fprint(b, "20 text/gemini; charset=utf-8\r\n")
+		fmt.Fprint(b, "# Room-based chat server\n\n")
+		if banner != "" {
+			fmt.Fprintf(b, "> notice: %s\n\n",
+				html.UnescapeString(banner))
+		}
+		for name := range rooms {
+			fmt.Fprintf(b, "=> /%s %s\n", name, name)
+		}
+		fmt.Fprint(b, "\nvisit /name to make or join a room\n")
+	case name == "":
+		fmt.Fprint(b, "51 not found\r\n")
+	case sub == "":
+		name, _ = resolve(name)
+		rm, ok := rooms[name]
+		if !ok {
+			fmt.Fprintf(b, "20 text/gemini; charset=utf-8\r\n"+
+				"# %s\n\nempty room\n\n=> /%s/post post\n",
+				name, name)
+			return
+		}
+
+		fmt.Fprint(b, "20 text/gemini; charset=utf-8\r\n")
+		fmt.Fprintf(b, "# %s\n\n", name)
+		if banner != "" {
+			fmt.Fprintf(b, "> notice: %s\n\n",
+				html.UnescapeString(banner))
+		}
+		fmt.Fprintf(b, "=> /%s/post post\n\n", name)
+		for i := rm.msgs.Len() - 1; i >= 0; i-- {
+			// Timestamps lead, so no msg reads as gemtext markup.
+			fmt.Fprintf(b, "%s\n", rm.msgs.At(i))
+		}
+	case sub == "post":
+		if u.RawQuery == "" {
+			fmt.Fprintf(b, "10 message for %s\r\n", name)
+			return
+		}
+
+		str, err := url.QueryUnescape(u.RawQuery)
+		if err != nil {
+			fmt.Fprint(b, "59 bad query\r\n")
+			return
+		}
+
+		name, _ = resolve(name)
+		_, exists := rooms[name]
+		err = errGeoBlocked
+		if !geoBlocked(host, !exists) {
+			lock.Unlock()
+			_, err = addMsg(name, str, clientID(host))
+			lock.Lock()
+		}
+
+		switch err {
+		case nil, errHeld:
+			fmt.Fprintf(b, "30 /%s\r\n", name)
+		case errSlowDown:
+			fmt.Fprintf(b, "44 %s\r\n", err)
+		default:
+			fmt.Fprintf(b, "59 %s\r\n", err)
+		}
+	default:
+		fmt.Fprint(b, "51 not found\r\n")
+	}
+}
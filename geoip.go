@@ -0,0 +1,66 @@
+package chat
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP restrictions are off unless an operator supplies a country database.
+var (
+	geoDB    *maxminddb.Reader
+	geoAllow map[string]bool // if non-empty, only these countries
+	geoDeny  map[string]bool
+
+	// geoPosting also restricts posting, not only room creation.
+	geoPosting bool
+
+	errGeoBlocked = errors.New("not available in your region")
+)
+
+// parseCountries parses a comma-separated list of ISO 3166 country codes.
+func parseCountries(s string) map[string]bool {
+	m := make(map[string]bool)
+
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			m[c] = true
+		}
+	}
+
+	return m
+}
+
+// geoBlocked reports whether the client at host may not create a room (if
+// creating) or post to one. Addresses missing from the database are judged
+// by the deny list only.
+func geoBlocked(host string, creating bool) bool {
+	if geoDB == nil || (!creating && !geoPosting) {
+		return false
+	}
+
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	if err := geoDB.Lookup(ip, &rec); err != nil {
+		return false
+	}
+
+	c := rec.Country.ISOCode
+
+	if geoDeny[c] {
+		return true
+	}
+
+	return c != "" && len(geoAllow) > 0 && !geoAllow[c]
+}
@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// gopher answers a single gopher (RFC 1436) request. The empty selector is a
+// menu of rooms, and "/name" is that room's history as a text file. Rooms are
+// never created over gopher.
+func gopher(c net.Conn, host string) {
+	defer c.Close()
+
+	if err := c.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return
+	}
+
+	sel, err := bufio.NewReader(io.LimitReader(c, 256)).ReadString('\n')
+	if err != nil {
+		return
+	}
+	sel = strings.TrimRight(sel, "\r\n")
+
+	lhost, port, err := net.SplitHostPort(c.LocalAddr().String())
+	if err != nil {
+		return
+	}
+	if host == "" {
+		host = lhost
+	}
+
+	var b bytes.Buffer
+
+	lock.Lock()
+
+	switch name := strings.ToLower(strings.TrimPrefix(sel, "/")); {
+	case name == "":
+		fmt.Fprintf(&b, "iRoom-based chat server\t\tnull.host\t1\r\n")
+		fmt.Fprintf(&b, "i\t\tnull.host\t1\r\n")
+		for name := range rooms {
+			fmt.Fprintf(&b, "0%s\t/%s\t%s\t%s\r\n", name, name, host,
+				port)
+		}
+		fmt.Fprintf(&b, "i\t\tnull.host\t1\r\n")
+		fmt.Fprintf(&b, "iroom lifespan: %s\t\tnull.host\t1\r\n",
+			lifespan)
+	default:
+		rm, ok := rooms[name]
+		if !ok || len(name) > maxNameLen || !validName.MatchString(name) {
+			fmt.Fprintf(&b, "3no such room\t\terror.host\t1\r\n")
+			break
+		}
+
+		for i := rm.msgs.Len() - 1; i >= 0; i-- {
+			line := rm.msgs.At(i).String()
+
+			// Dot-stuff lines that would read as the terminator.
+			if strings.HasPrefix(line, ".") {
+				line = "." + line
+			}
+
+			fmt.Fprintf(&b, "%s\r\n", line)
+		}
+	}
+
+	lock.Unlock()
+
+	b.WriteString(".\r\n")
+	_, _ = b.WriteTo(c)
+}
@@ -0,0 +1,424 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of chat.proto are few and small, so they are encoded by hand
+// rather than generated.
+type (
+	pbRooms   []apiRoom // ListRoomsResponse
+	pbMsgs    []apiMsg  // GetMessagesResponse
+	pbMsg     apiMsg    // Message
+	pbNothing struct{}  // ListRoomsRequest
+
+	// pbPosted is PostMessageResponse.
+	pbPosted struct {
+		seq  uint64
+		held bool
+	}
+
+	// pbRange is GetMessagesRequest and StreamMessagesRequest.
+	pbRange struct {
+		room  string
+		after uint64
+	}
+
+	// pbPost is PostMessageRequest.
+	pbPost struct {
+		room, text string
+	}
+)
+
+// pbEncoder is a response, appending its encoding to b.
+type pbEncoder interface {
+	encode(b []byte) []byte
+}
+
+// pbDecoder is a request, setting the field num from the value at the start
+// of b and returning its length, or 0 if the field is unknown.
+type pbDecoder interface {
+	decode(num protowire.Number, typ protowire.Type, b []byte) int
+}
+
+// pbCodec encodes the messages of chat.proto in the protobuf wire format.
+type pbCodec struct{}
+
+func (pbCodec) Name() string { return "proto" }
+
+func (pbCodec) Marshal(v interface{}) ([]byte, error) {
+	e, ok := v.(pbEncoder)
+	if !ok {
+		return nil, errors.New("grpc: cannot encode response")
+	}
+	return e.encode(nil), nil
+}
+
+func (pbCodec) Unmarshal(b []byte, v interface{}) error {
+	d, ok := v.(pbDecoder)
+	if !ok {
+		return errors.New("grpc: cannot decode request")
+	}
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if n = d.decode(num, typ, b); n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendTime appends t as a google.protobuf.Timestamp.
+func appendTime(b []byte, num protowire.Number, t time.Time) []byte {
+	ts := appendVarint(nil, 1, uint64(t.Unix()))
+	ts = appendVarint(ts, 2, uint64(t.Nanosecond()))
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, ts)
+}
+
+func (m pbMsg) encode(b []byte) []byte {
+	b = appendVarint(b, 1, m.Seq)
+	b = appendTime(b, 2, m.Time)
+	return appendString(b, 3, m.Text)
+}
+
+func (list pbMsgs) encode(b []byte) []byte {
+	for _, m := range list {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, pbMsg(m).encode(nil))
+	}
+	return b
+}
+
+func (list pbRooms) encode(b []byte) []byte {
+	for _, rm := range list {
+		e := appendString(nil, 1, rm.Name)
+		e = appendTime(e, 2, rm.Last)
+		e = appendVarint(e, 3, rm.Seq)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, e)
+	}
+	return b
+}
+
+func (p pbPosted) encode(b []byte) []byte {
+	if p.held {
+		return appendVarint(b, 2, 1)
+	}
+	return appendVarint(b, 1, p.seq)
+}
+
+func (*pbNothing) decode(protowire.Number, protowire.Type, []byte) int {
+	return 0
+}
+
+func (r *pbRange) decode(num protowire.Number, typ protowire.Type,
+	b []byte) int {
+	switch {
+	case num == 1 && typ == protowire.BytesType:
+		var n int
+		r.room, n = protowire.ConsumeString(b)
+		return n
+	case num == 2 && typ == protowire.VarintType:
+		var n int
+		r.after, n = protowire.ConsumeVarint(b)
+		return n
+	}
+	return 0
+}
+
+func (p *pbPost) decode(num protowire.Number, typ protowire.Type,
+	b []byte) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+
+	var n int
+	switch num {
+	case 1:
+		p.room, n = protowire.ConsumeString(b)
+	case 2:
+		p.text, n = protowire.ConsumeString(b)
+	}
+	return n
+}
+
+// chatService is the Chat service of chat.proto.
+var chatService = grpc.ServiceDesc{
+	ServiceName: "chat.v1.Chat",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "ListRooms",
+		Handler: unary(func() pbDecoder { return &pbNothing{} },
+			grpcListRooms),
+	}, {
+		MethodName: "GetMessages",
+		Handler: unary(func() pbDecoder { return &pbRange{} },
+			grpcGetMessages),
+	}, {
+		MethodName: "PostMessage",
+		Handler: unary(func() pbDecoder { return &pbPost{} },
+			grpcPostMessage),
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "StreamMessages",
+		Handler:       grpcStreamMessages,
+		ServerStreams: true,
+	}},
+	Metadata: "chat.proto",
+}
+
+// newGRPC returns the gRPC server of the Chat service.
+func newGRPC() *grpc.Server {
+	gs := grpc.NewServer(grpc.ForceServerCodec(pbCodec{}))
+	gs.RegisterService(&chatService, struct{}{})
+	return gs
+}
+
+// unary adapts f to a method of chatService, decoding its request into
+// what req returns. No interceptors are installed.
+func unary(req func() pbDecoder,
+	f func(ctx context.Context, req pbDecoder) (pbEncoder, error)) func(
+	interface{}, context.Context, func(interface{}) error,
+	grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(_ interface{}, ctx context.Context,
+		dec func(interface{}) error,
+		_ grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := req()
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		return f(ctx, in)
+	}
+}
+
+// grpcClient returns the address of the client, for limits and client IDs.
+func grpcClient(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// grpcRead takes a read token for the client, as page loads do.
+func grpcRead(ctx context.Context) error {
+	if ok, _ := readLimit.allow(clientID(grpcClient(ctx))); !ok {
+		return status.Error(codes.ResourceExhausted, "too many requests")
+	}
+	return nil
+}
+
+// grpcError translates errors of posting to their gRPC status.
+func grpcError(err error) error {
+	switch postStatus(err) {
+	case http.StatusTooManyRequests:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case http.StatusServiceUnavailable:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+func grpcBadName(name string) error {
+	if name == "" || len(name) > maxNameLen || !validName.MatchString(name) {
+		return status.Error(codes.InvalidArgument, "bad name")
+	}
+	return nil
+}
+
+func grpcListRooms(ctx context.Context, _ pbDecoder) (pbEncoder, error) {
+	if err := grpcRead(ctx); err != nil {
+		return nil, err
+	}
+
+	lock.RLock()
+	list := make(pbRooms, 0, len(rooms))
+	for name, rm := range rooms {
+		rm.mu.Lock()
+		list = append(list, apiRoom{
+			Name: name,
+			Last: rm.last,
+			Seq:  rm.seq,
+		})
+		rm.mu.Unlock()
+	}
+	lock.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list, nil
+}
+
+func grpcGetMessages(ctx context.Context, in pbDecoder) (pbEncoder, error) {
+	req := in.(*pbRange)
+	if err := grpcBadName(req.room); err != nil {
+		return nil, err
+	}
+	if err := grpcRead(ctx); err != nil {
+		return nil, err
+	}
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	name, _ := resolve(req.room)
+	rm, ok := rooms[name]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no such room")
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	return pbMsgs(apiMsgList(rm, msgRange{afterSeq: req.after})), nil
+}
+
+func grpcPostMessage(ctx context.Context, in pbDecoder) (pbEncoder, error) {
+	req := in.(*pbPost)
+	if err := grpcBadName(req.room); err != nil {
+		return nil, err
+	}
+
+	host := grpcClient(ctx)
+	if listed(host) {
+		if ok, _ := listedLimit.allow(clientID(host)); !ok {
+			return nil, status.Error(codes.ResourceExhausted,
+				"too many requests")
+		}
+	}
+
+	lock.RLock()
+	name, _ := resolve(req.room)
+	_, exists := rooms[name]
+	lock.RUnlock()
+
+	blocked := geoBlocked(host, !exists)
+
+	if blocked {
+		return nil, status.Error(codes.PermissionDenied,
+			errGeoBlocked.Error())
+	}
+
+	seq, err := addMsg(name, req.text, clientID(host))
+	if err == errHeld {
+		return pbPosted{held: true}, nil
+	} else if err != nil {
+		return nil, grpcError(err)
+	}
+	return pbPosted{seq: seq}, nil
+}
+
+// grpcStreamMessages serves StreamMessages like /events/name, following the
+// room through renames.
+func grpcStreamMessages(_ interface{}, stream grpc.ServerStream) error {
+	var req pbRange
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	if err := grpcBadName(req.room); err != nil {
+		return err
+	}
+	if err := grpcRead(stream.Context()); err != nil {
+		return err
+	}
+
+	lock.RLock()
+	name, _ := resolve(req.room)
+	_, ok := rooms[name]
+	lock.RUnlock()
+
+	if !ok {
+		return status.Error(codes.NotFound, "no such room")
+	}
+
+	streams.Add(1)
+	defer streams.Done()
+
+	sub := watch(name)
+	defer sub.stop()
+
+	seen := req.after
+	stopping := false
+
+	for {
+		lock.RLock()
+		rm, ok := rooms[name]
+		if !ok {
+			to, moved := resolve(name)
+			lock.RUnlock()
+			if !moved {
+				return status.Error(codes.NotFound,
+					"room expired")
+			}
+			name = to
+			sub.follow(to)
+			continue
+		}
+		rm.mu.Lock()
+		list := apiMsgList(rm, msgRange{afterSeq: seen})
+		seen = rm.seq
+		rm.unlock()
+
+		for _, m := range list {
+			if err := stream.SendMsg(pbMsg(m)); err != nil {
+				return err
+			}
+		}
+
+		// One last pass delivers msgs posted before shutdown.
+		if stopping {
+			msg := "server upgrading, reconnect"
+			if noticeShutdown() {
+				msg = shutdownNotice
+			}
+			return status.Error(codes.Unavailable, msg)
+		}
+
+		select {
+		case <-sub.c:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-shutdown:
+			stopping = true
+		}
+	}
+}
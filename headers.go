@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Security header settings. The defaults suit a public HTTPS deployment that
+// is never framed; operators behind proxies, embedding rooms, or serving
+// plain HTTP on a LAN can relax them with flags.
+var (
+	// hsts is the Strict-Transport-Security value, omitted if empty.
+	hsts = "max-age=31536000;includeSubDomains;preload"
+
+	// frameAncestors is the CSP frame-ancestors source list, omitted if
+	// empty. X-Frame-Options is derived from it where possible.
+	frameAncestors = "'none'"
+
+	// cspExtra is appended to every Content-Security-Policy.
+	cspExtra string
+)
+
+// setCSP sets the Content-Security-Policy to policy plus the configured
+// frame-ancestors and extra directives.
+func setCSP(w http.ResponseWriter, policy string) {
+	parts := []string{strings.TrimSuffix(policy, ";")}
+
+	if frameAncestors != "" {
+		parts = append(parts, "frame-ancestors "+frameAncestors)
+	}
+
+	if cspExtra != "" {
+		parts = append(parts, cspExtra)
+	}
+
+	w.Header().Set("Content-Security-Policy", strings.Join(parts, "; "))
+}
+
+// securityHeaders sets the headers common to every response.
+func securityHeaders(w http.ResponseWriter) {
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if hsts != "" {
+		w.Header().Set("Strict-Transport-Security", hsts)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-XSS-Protection", "1")
+
+	// X-Frame-Options cannot express a source list, so it is only sent
+	// for the two values it can.
+	switch frameAncestors {
+	case "'none'":
+		w.Header().Set("X-Frame-Options", "deny")
+	case "'self'":
+		w.Header().Set("X-Frame-Options", "sameorigin")
+	}
+}
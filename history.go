@@ -0,0 +1,60 @@
+package chat
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var errBadRange = errors.New("bad after or before, want a sequence " +
+	"number or RFC 3339 time")
+
+// msgRange selects msgs strictly between after and before, each either a
+// sequence number or a time. The zero msgRange selects every msg.
+type msgRange struct {
+	afterSeq, beforeSeq uint64
+	after, before       time.Time
+}
+
+// parseRange reads ?after= and ?before= from q.
+func parseRange(q url.Values) (msgRange, error) {
+	var mr msgRange
+
+	parse := func(s string, seq *uint64, t *time.Time) error {
+		if s == "" {
+			return nil
+		}
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			*seq = n
+			return nil
+		}
+		pt, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return errBadRange
+		}
+		*t = pt
+		return nil
+	}
+
+	if err := parse(q.Get("after"), &mr.afterSeq, &mr.after); err != nil {
+		return mr, err
+	}
+	if err := parse(q.Get("before"), &mr.beforeSeq,
+		&mr.before); err != nil {
+		return mr, err
+	}
+
+	return mr, nil
+}
+
+func (mr msgRange) has(m msg) bool {
+	switch {
+	case mr.afterSeq != 0 && m.seq <= mr.afterSeq,
+		mr.beforeSeq != 0 && m.seq >= mr.beforeSeq,
+		!mr.after.IsZero() && !m.at.After(mr.after),
+		!mr.before.IsZero() && !m.at.Before(mr.before):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,304 @@
+package chat
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// hookLimit rate limits posts by each incoming hook, apart from people.
+var hookLimit = newLimiter(1, 5)
+
+// hook is an incoming webhook, posting to room whoever has its token.
+type hook struct {
+	room string
+
+	// id identifies the hook to admins and in rate limits, without
+	// revealing the token.
+	id string
+
+	// fromFile is set for hooks from -hook-tokens-file, which are
+	// reloaded on restart, unlike those added over /admin.
+	fromFile bool
+}
+
+// hooks are the incoming webhooks, by SHA-256 of their token. Guarded by the
+// global lock.
+var hooks = make(map[[sha256.Size]byte]hook)
+
+func addHook(room, token string, fromFile bool) hook {
+	sum := sha256.Sum256([]byte(token))
+	h := hook{
+		room:     room,
+		id:       hex.EncodeToString(sum[:4]),
+		fromFile: fromFile,
+	}
+	hooks[sum] = h
+	return h
+}
+
+// loadHooks reads incoming webhooks from path, one "room token" per line.
+// Blank lines and lines starting with # are skipped.
+func loadHooks(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) > maxNameLen ||
+			!validName.MatchString(fields[0]) {
+			return fmt.Errorf("%s:%d: want \"room token\"", path, n)
+		}
+
+		addHook(fields[0], fields[1], true)
+	}
+
+	return s.Err()
+}
+
+// hookHandler serves POST /hooks/token, posting the msg in the form value
+// msg, the text/plain body, or a Slack webhook payload to the hook's room.
+func hookHandler(w http.ResponseWriter, r *http.Request) {
+	setCSP(w, "default-src 'none';")
+
+	if r.Method != "POST" {
+		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/hooks/")
+	sum := sha256.Sum256([]byte(token))
+
+	lock.Lock()
+	h, ok := hooks[sum]
+	lock.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !limitKey(hookLimit, h.id, w) {
+		return
+	}
+
+	var str string
+	ctype := r.Header.Get("Content-Type")
+	slack := strings.HasPrefix(ctype, "application/json")
+	if slack {
+		var err error
+		if str, err = slackText(http.MaxBytesReader(w, r.Body,
+			maxSlackBody)); err != nil {
+			http.Error(w, "body invalid", http.StatusBadRequest)
+			return
+		}
+	} else if strings.HasPrefix(ctype, "text/plain") {
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body,
+			maxMsgLen*utf8.UTFMax+2))
+		if err != nil {
+			http.Error(w, "body invalid", http.StatusBadRequest)
+			return
+		}
+		str = strings.TrimRight(string(b), "\r\n")
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "form invalid", http.StatusBadRequest)
+			return
+		}
+		str = r.PostFormValue("msg")
+
+		// Slack also accepts the JSON as the form value payload.
+		if p, ok := r.PostForm["payload"]; ok && str == "" {
+			var err error
+			if str, err = slackText(strings.NewReader(
+				p[0])); err != nil {
+				http.Error(w, "payload invalid",
+					http.StatusBadRequest)
+				return
+			}
+			slack = true
+		}
+	}
+
+	err := addHookMsg(h.room, str, "hook:"+h.id)
+
+	if err != nil && err != errHeld {
+		http.Error(w, err.Error(), postStatus(err))
+		return
+	}
+
+	// Slack replies "ok", which some integrations check for.
+	if slack {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, "ok")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// maxSlackBody bounds Slack payloads, which may carry attachments besides
+// the text.
+const maxSlackBody = 64 << 10
+
+// slackMsg is the part of a Slack incoming webhook payload that is used.
+// Integrations sending only attachments, as some alerting tools do, have
+// their fallback text posted instead.
+type slackMsg struct {
+	Text        string `json:"text"`
+	Attachments []struct {
+		Fallback string `json:"fallback"`
+		Title    string `json:"title"`
+		Text     string `json:"text"`
+	} `json:"attachments"`
+}
+
+// slackLink matches Slack's <url> and <url|label> link markup.
+var slackLink = regexp.MustCompile(`<([^<>|]+)(?:\|([^<>]+))?>`)
+
+// slackText reads a Slack payload, returning its text as one plain line.
+func slackText(r io.Reader) (string, error) {
+	var m slackMsg
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return "", err
+	}
+
+	str := m.Text
+	for _, a := range m.Attachments {
+		if str != "" {
+			break
+		}
+		switch {
+		case a.Fallback != "":
+			str = a.Fallback
+		case a.Title != "" && a.Text != "":
+			str = a.Title + ": " + a.Text
+		default:
+			str = a.Title + a.Text
+		}
+	}
+
+	str = slackLink.ReplaceAllStringFunc(str, func(s string) string {
+		sub := slackLink.FindStringSubmatch(s)
+		if sub[2] == "" {
+			return sub[1]
+		}
+		return sub[2] + " (" + sub[1] + ")"
+	})
+	str = strings.NewReplacer("&lt;", "<", "&gt;", ">",
+		"&amp;", "&").Replace(str)
+
+	// Msgs are one line, and alerts may run longer than msgs can.
+	str = strings.Join(strings.Fields(str), " ")
+	if r := []rune(str); len(r) > maxMsgLen {
+		str = string(r[:maxMsgLen-1]) + "…"
+	}
+
+	return str, nil
+}
+
+// addHookMsg is addMsg for hooks, which are exempt from newcomer limits as
+// they have their own. The global lock must not be held.
+func addHookMsg(name, str, id string) error {
+	if following {
+		return errStandby
+	}
+	if raftFollower() {
+		return errNotLeader
+	}
+
+	str, err := cleanMsg(str)
+	if err != nil {
+		return err
+	}
+
+	if str, err = moderate(name, str, id); err != nil {
+		return err
+	}
+
+	if str, err = beforePost(name, str); err != nil {
+		return err
+	}
+
+	_, err = submitMsg(name, str, id, "")
+	return err
+}
+
+// adminHooks lists the incoming webhooks as "id room source", sorted by
+// room.
+func adminHooks(w http.ResponseWriter, r *http.Request) {
+	list := make([]hook, 0, len(hooks))
+	for _, h := range hooks {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].room != list[j].room {
+			return list[i].room < list[j].room
+		}
+		return list[i].id < list[j].id
+	})
+
+	for _, h := range list {
+		src := "admin"
+		if h.fromFile {
+			src = "file"
+		}
+		fmt.Fprintf(w, "%s %s %s\n", h.id, h.room, src)
+	}
+}
+
+// adminNewHook adds an incoming webhook to the room, replying with its token.
+// It lasts until restart; add it to -hook-tokens-file to keep it.
+func adminNewHook(w http.ResponseWriter, r *http.Request) {
+	name := r.PostFormValue("room")
+	if name == "" || len(name) > maxNameLen || !validName.MatchString(name) ||
+		reserved[name] {
+		http.Error(w, "bad name", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(b)
+
+	h := addHook(name, token, false)
+	fmt.Fprintf(w, "%s %s %s\n", h.id, name, token)
+}
+
+// adminRevokeHook removes the incoming webhook with the given id.
+func adminRevokeHook(w http.ResponseWriter, r *http.Request) {
+	id := r.PostFormValue("id")
+
+	for sum, h := range hooks {
+		if h.id == id {
+			delete(hooks, sum)
+			fmt.Fprintf(w, "revoked %s\n", id)
+			return
+		}
+	}
+
+	http.Error(w, "no such hook: "+id, http.StatusNotFound)
+}
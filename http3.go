@@ -0,0 +1,33 @@
+package chat
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3 returns an HTTP/3 server of h, using the certificates of config.
+// QUIC streams are independent, so a lost packet stalls only the request it
+// belongs to, not every poll sharing the connection.
+func newHTTP3(h http.Handler, config *tls.Config) *http3.Server {
+	return &http3.Server{
+		Handler: h,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			GetCertificate: config.GetCertificate,
+			MinVersion:     tls.VersionTLS13,
+		}),
+	}
+}
+
+// altSvc advertises HTTP/3 on the UDP port of pc, so browsers switch to it
+// for later requests.
+func altSvc(pc net.PacketConn, next http.Handler) http.Handler {
+	v := fmt.Sprintf(`h3=":%d"; ma=86400`, pc.LocalAddr().(*net.UDPAddr).Port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", v)
+		next.ServeHTTP(w, r)
+	})
+}
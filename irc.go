@@ -0,0 +1,395 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ircServer is the server name in IRC replies.
+const ircServer = "chat"
+
+// ircClient is a connection to the IRC gateway. Each joined channel is a
+// room, followed by its own goroutine.
+type ircClient struct {
+	c    net.Conn
+	host string
+	id   string
+	nick string
+
+	mu    sync.Mutex // serializes writes
+	chans map[string]chan struct{}
+
+	// from marks the msgs this client posts, which IRC clients have
+	// already shown themselves.
+	from string
+}
+
+func (ic *ircClient) send(format string, a ...interface{}) error {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if err := ic.c.SetWriteDeadline(time.Now().Add(
+		10 * time.Second)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(ic.c, format+"\r\n", a...)
+	return err
+}
+
+func (ic *ircClient) reply(code, format string, a ...interface{}) error {
+	return ic.send(":%s %s %s "+format,
+		append([]interface{}{ircServer, code, ic.nick}, a...)...)
+}
+
+// ircConn serves an IRC session over c, mapping rooms to channels: JOIN
+// shows the history, and PRIVMSG posts like any other client.
+func ircConn(c net.Conn) {
+	defer c.Close()
+
+	ic := &ircClient{
+		c:     c,
+		host:  remoteHost(c),
+		nick:  "*",
+		chans: make(map[string]chan struct{}),
+	}
+	ic.id = clientID(ic.host)
+	ic.from = fmt.Sprintf("irc:%p", ic)
+
+	defer func() {
+		lock.Lock()
+		for _, part := range ic.chans {
+			close(part)
+		}
+		lock.Unlock()
+	}()
+
+	sc := bufio.NewScanner(c)
+	sc.Buffer(make([]byte, 0, 512), 512)
+
+	registered := false
+	user := false
+
+	for sc.Scan() {
+		cmd, args := ircParse(sc.Text())
+
+		var err error
+		switch cmd {
+		case "":
+			continue
+		case "CAP":
+			if len(args) > 0 && args[0] == "LS" {
+				err = ic.send(":%s CAP * LS :", ircServer)
+			}
+		case "NICK":
+			if len(args) == 0 {
+				err = ic.reply("431", ":No nickname given")
+				break
+			}
+			// Nicks are echoed in replies, so are held to room
+			// names.
+			if args[0] == "" || len(args[0]) > maxNameLen ||
+				!validName.MatchString(args[0]) {
+				err = ic.reply("432", "%s :Erroneous nickname",
+					args[0])
+				break
+			}
+			if registered {
+				err = ic.send(":%s NICK :%s", ic.nick, args[0])
+			}
+			ic.nick = args[0]
+		case "USER":
+			user = true
+		case "PING":
+			err = ic.send(":%s PONG %s :%s", ircServer, ircServer,
+				strings.Join(args, " "))
+		case "QUIT":
+			return
+		default:
+			if !registered {
+				err = ic.reply("451", ":You have not registered")
+				break
+			}
+			err = ic.command(cmd, args)
+		}
+
+		if err == nil && !registered && user && ic.nick != "*" {
+			registered = true
+			err = ic.welcome()
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ircParse splits an IRC line into its command and parameters, dropping any
+// prefix.
+func ircParse(line string) (string, []string) {
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return "", nil
+		}
+		line = line[i+1:]
+	}
+
+	var args []string
+	for line != "" {
+		if line[0] == ':' {
+			args = append(args, line[1:])
+			break
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			args = append(args, line)
+			break
+		}
+		if i > 0 {
+			args = append(args, line[:i])
+		}
+		line = line[i+1:]
+	}
+
+	if len(args) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(args[0]), args[1:]
+}
+
+func (ic *ircClient) welcome() error {
+	for _, r := range [][2]string{
+		{"001", ":Welcome to the chat IRC gateway"},
+		{"002", ":Your host is " + ircServer},
+		{"003", ":Rooms are channels, msgs are anonymous"},
+		{"004", ircServer + " chat o o"},
+		{"422", ":MOTD File is missing"},
+	} {
+		if err := ic.reply(r[0], "%s", r[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ic *ircClient) command(cmd string, args []string) error {
+	switch cmd {
+	case "JOIN":
+		if len(args) == 0 {
+			return ic.reply("461", "JOIN :Not enough parameters")
+		}
+		for _, ch := range strings.Split(args[0], ",") {
+			if err := ic.join(ch); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "PART":
+		if len(args) == 0 {
+			return ic.reply("461", "PART :Not enough parameters")
+		}
+		for _, ch := range strings.Split(args[0], ",") {
+			if err := ic.part(ch); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "PRIVMSG", "NOTICE":
+		if len(args) < 2 {
+			return ic.reply("412", ":No text to send")
+		}
+		return ic.privmsg(args[0], args[1], cmd == "PRIVMSG")
+	case "MODE":
+		if len(args) > 0 && strings.HasPrefix(args[0], "#") {
+			return ic.reply("324", "%s +n", args[0])
+		}
+		return nil
+	case "WHO":
+		if len(args) == 0 {
+			args = []string{"*"}
+		}
+		return ic.reply("315", "%s :End of WHO list", args[0])
+	}
+
+	return ic.reply("421", "%s :Unknown command", cmd)
+}
+
+// ircRoom returns the room name of the channel ch, or "" if it is invalid.
+func ircRoom(ch string) string {
+	if !strings.HasPrefix(ch, "#") {
+		return ""
+	}
+	name := strings.ToLower(ch[1:])
+	if name == "" || len(name) > maxNameLen || !validName.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+func (ic *ircClient) join(ch string) error {
+	name := ircRoom(ch)
+	if name == "" {
+		return ic.reply("403", "%s :No such channel", ch)
+	}
+	ch = "#" + name
+
+	if _, ok := ic.chans[ch]; ok {
+		return nil
+	}
+
+	lock.Lock()
+	pruneRooms()
+	name, _ = resolve(name)
+	_, exists := rooms[name]
+	err := errGeoBlocked
+	if !geoBlocked(ic.host, !exists) {
+		err = createRoom(name)
+	}
+	lock.Unlock()
+
+	if err != nil {
+		return ic.reply("403", "%s :%s", ch, err)
+	}
+
+	part := make(chan struct{})
+	lock.Lock()
+	ic.chans[ch] = part
+	lock.Unlock()
+
+	if err := ic.send(":%s!%s@%s JOIN %s", ic.nick, ic.nick, ircServer,
+		ch); err != nil {
+		return err
+	}
+	if err := ic.reply("332", "%s :room %s, history follows", ch,
+		name); err != nil {
+		return err
+	}
+	if err := ic.reply("353", "= %s :%s", ch, ic.nick); err != nil {
+		return err
+	}
+	if err := ic.reply("366", "%s :End of NAMES list", ch); err != nil {
+		return err
+	}
+
+	streams.Add(1)
+	go ic.follow(ch, name, part)
+
+	return nil
+}
+
+func (ic *ircClient) part(ch string) error {
+	lock.Lock()
+	part, ok := ic.chans[ch]
+	if ok {
+		close(part)
+		delete(ic.chans, ch)
+	}
+	lock.Unlock()
+
+	if !ok {
+		return ic.reply("442", "%s :You're not on that channel", ch)
+	}
+	return ic.send(":%s!%s@%s PART %s", ic.nick, ic.nick, ircServer, ch)
+}
+
+func (ic *ircClient) privmsg(ch, text string, answer bool) error {
+	lock.RLock()
+	_, ok := ic.chans[ch]
+	if !ok {
+		lock.RUnlock()
+		if !answer {
+			return nil
+		}
+		return ic.reply("442", "%s :You're not on that channel", ch)
+	}
+
+	name, _ := resolve(ircRoom(ch))
+	lock.RUnlock()
+
+	blocked := geoBlocked(ic.host, false)
+
+	err := errGeoBlocked
+	if !blocked {
+		_, err = addMsgFrom(name, text, ic.id, ic.from)
+	}
+
+	// NOTICEs must not be answered.
+	if err == nil || !answer {
+		return nil
+	}
+	return ic.send(":%s NOTICE %s :%s", ircServer, ch, err)
+}
+
+// follow relays new msgs in the room name to the channel ch until the client
+// parts, as for line sessions. History is sent with timestamps.
+func (ic *ircClient) follow(ch, name string, part <-chan struct{}) {
+	defer streams.Done()
+
+	var seen uint64
+	history := true
+	stopping := false
+
+	sub := watch(name)
+	defer sub.stop()
+
+	for {
+		var lines []string
+
+		lock.RLock()
+		rm, ok := rooms[name]
+		if !ok {
+			if to, moved := resolve(name); moved {
+				name = to
+				sub.follow(to)
+				lock.RUnlock()
+				continue
+			}
+			lock.RUnlock()
+			_ = ic.send(":%s NOTICE %s :room expired", ircServer, ch)
+			return
+		}
+		rm.mu.Lock()
+		for i := rm.msgs.Len() - 1; i >= 0; i-- {
+			m := rm.msgs.At(i)
+			switch {
+			case m.seq <= seen:
+			case history:
+				lines = append(lines, m.String())
+			case m.from != ic.from:
+				lines = append(lines, html.UnescapeString(m.s))
+			}
+		}
+		seen = rm.seq
+		rm.unlock()
+
+		history = false
+
+		for _, line := range lines {
+			if ic.send(":anon!anon@%s PRIVMSG %s :%s", ircServer, ch,
+				line) != nil {
+				return
+			}
+		}
+
+		if stopping {
+			if noticeShutdown() {
+				_ = ic.send(":%s NOTICE %s :%s", ircServer, ch,
+					shutdownNotice)
+			}
+			return
+		}
+
+		select {
+		case <-sub.c:
+		case <-part:
+			return
+		case <-shutdown:
+			stopping = true
+		}
+	}
+}
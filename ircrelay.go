@@ -0,0 +1,297 @@
+package chat
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ircRelayRetry is how long the relay waits to reconnect.
+	ircRelayRetry = 30 * time.Second
+
+	// ircRelayPace spaces lines sent to the network, which would
+	// otherwise disconnect the relay for flooding.
+	ircRelayPace = 700 * time.Millisecond
+)
+
+var (
+	// ircRelayURL is the network the relay connects to, as
+	// irc://host:port or ircs://host:port. Disabled if empty.
+	ircRelayURL      string
+	ircRelayNick     string
+	ircRelayPassword string
+
+	// ircRelayChannels maps mirrored rooms to channels.
+	ircRelayChannels map[string]string
+
+	// ircRelayBack also posts what others say in the channels to the
+	// rooms.
+	ircRelayBack bool
+
+	// ircFormat matches IRC formatting codes.
+	ircFormat = regexp.MustCompile(
+		"\x03([0-9]{1,2}(,[0-9]{1,2})?)?|[\x02\x0f\x11\x16\x1d\x1e\x1f]")
+)
+
+// ircRelay is one connection of the relay to the network.
+type ircRelay struct {
+	c    net.Conn
+	nick string
+
+	mu sync.Mutex // serializes and paces writes
+}
+
+// parseIRCRelayChannels parses a comma-separated list of room=#channel.
+func parseIRCRelayChannels(s string) (map[string]string, error) {
+	m := make(map[string]string)
+
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+
+		name, ch, ok := strings.Cut(f, "=")
+		if !ok || name == "" || len(name) > maxNameLen ||
+			!validName.MatchString(name) || reserved[name] {
+			return nil, fmt.Errorf("irc relay: bad room in %q", f)
+		}
+		if !strings.HasPrefix(ch, "#") || strings.ContainsAny(ch,
+			" ,\x07") {
+			return nil, fmt.Errorf("irc relay: bad channel in %q", f)
+		}
+
+		m[name] = ch
+	}
+
+	return m, nil
+}
+
+// ircRelayLoop keeps the relay connected until shutdown.
+func ircRelayLoop() {
+	for {
+		if err := runIRCRelay(); err != nil {
+			log.Printf("irc relay: %v", err)
+		}
+
+		select {
+		case <-time.After(ircRelayRetry):
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+func dialIRCRelay() (net.Conn, error) {
+	u, err := url.Parse(ircRelayURL)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	switch u.Scheme {
+	case "irc":
+		return d.Dial("tcp", u.Host)
+	case "ircs":
+		return tls.DialWithDialer(d, "tcp", u.Host, &tls.Config{
+			ServerName: u.Hostname(),
+		})
+	}
+	return nil, fmt.Errorf("bad URL %q", ircRelayURL)
+}
+
+func (ir *ircRelay) send(format string, a ...interface{}) error {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+
+	if err := ir.c.SetWriteDeadline(time.Now().Add(
+		10 * time.Second)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(ir.c, format+"\r\n", a...); err != nil {
+		return err
+	}
+
+	time.Sleep(ircRelayPace)
+	return nil
+}
+
+// runIRCRelay connects to the network and mirrors the rooms until the
+// connection is lost or the server shuts down.
+func runIRCRelay() error {
+	c, err := dialIRCRelay()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ir := &ircRelay{
+		c:    c,
+		nick: ircRelayNick,
+	}
+
+	// Followers stop with the connection.
+	done := make(chan struct{})
+	var followers sync.WaitGroup
+	defer func() {
+		close(done)
+		followers.Wait()
+	}()
+
+	go func() {
+		select {
+		case <-shutdown:
+			_ = ir.send("QUIT :shutting down")
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	if ircRelayPassword != "" {
+		if err := ir.send("PASS %s", ircRelayPassword); err != nil {
+			return err
+		}
+	}
+	if err := ir.send("NICK %s", ir.nick); err != nil {
+		return err
+	}
+	if err := ir.send("USER %s 0 * :chat relay", ir.nick); err != nil {
+		return err
+	}
+
+	channels := make(map[string]string, len(ircRelayChannels))
+	for name, ch := range ircRelayChannels {
+		channels[strings.ToLower(ch)] = name
+	}
+
+	sc := bufio.NewScanner(c)
+	for sc.Scan() {
+		line := sc.Text()
+		cmd, args := ircParse(line)
+
+		switch cmd {
+		case "PING":
+			if len(args) == 0 {
+				args = []string{ircRelayNick}
+			}
+			err = ir.send("PONG :%s", args[0])
+		case "433": // nick in use
+			ir.nick += "_"
+			err = ir.send("NICK %s", ir.nick)
+		case "001": // registered
+			lock.Lock()
+			for name, ch := range ircRelayChannels {
+				followers.Add(1)
+				go ir.follow(name, ch, seqOf(name), done,
+					&followers)
+			}
+			lock.Unlock()
+
+			for _, ch := range ircRelayChannels {
+				if err = ir.send("JOIN %s", ch); err != nil {
+					break
+				}
+			}
+		case "PRIVMSG":
+			if len(args) < 2 || !ircRelayBack || raftFollower() {
+				break
+			}
+			name, ok := channels[strings.ToLower(args[0])]
+			if !ok {
+				break
+			}
+			ir.post(name, ircNick(line), args[1])
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s closed the connection", c.RemoteAddr())
+}
+
+// ircNick returns the nick in the prefix of an IRC line.
+func ircNick(line string) string {
+	if !strings.HasPrefix(line, ":") {
+		return ""
+	}
+	prefix := line[1:]
+	if i := strings.IndexByte(prefix, ' '); i >= 0 {
+		prefix = prefix[:i]
+	}
+	if i := strings.IndexByte(prefix, '!'); i >= 0 {
+		prefix = prefix[:i]
+	}
+	return prefix
+}
+
+// post posts what nick said in the channel to the room.
+func (ir *ircRelay) post(name, nick, text string) {
+	// CTCP, besides actions, is not for people.
+	if strings.HasPrefix(text, "\x01") {
+		if !strings.HasPrefix(text, "\x01ACTION ") {
+			return
+		}
+		text = strings.Trim(text[len("\x01ACTION "):], "\x01")
+	}
+	text = ircFormat.ReplaceAllString(text, "")
+
+	_, err := addMsgFrom(name, text, clientID("irc:"+nick), "irc-relay")
+	if err != nil && err != errHeld {
+		log.Printf("irc relay: %s: %v", name, err)
+	}
+}
+
+// follow relays new msgs in the room to the channel until done, as for IRC
+// gateway sessions. In a Raft cluster only the leader relays.
+func (ir *ircRelay) follow(name, ch string, seen uint64, done <-chan struct{},
+	followers *sync.WaitGroup) {
+	defer followers.Done()
+
+	sub := watch(name)
+	defer sub.stop()
+
+	for {
+		var lines []string
+
+		if rm, ok := rlockRoom(name); ok {
+			for i := rm.msgs.Len() - 1; i >= 0; i-- {
+				m := rm.msgs.At(i)
+				if m.seq > seen && m.relayed("irc-relay") {
+					lines = append(lines,
+						html.UnescapeString(m.s))
+				}
+			}
+			seen = rm.seq
+			rm.unlock()
+		} else {
+			// Pruned rooms start over.
+			seen = 0
+		}
+
+		for _, line := range lines {
+			if ir.send("PRIVMSG %s :%s", ch, line) != nil {
+				return
+			}
+		}
+
+		// Rooms not yet created wake their watchers once created.
+		select {
+		case <-sub.c:
+		case <-done:
+			return
+		}
+	}
+}
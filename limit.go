@@ -0,0 +1,117 @@
+package chat
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limiter is a token bucket per client ID.
+type limiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets bounds how many buckets are kept before they are swept.
+const maxBuckets = 10000
+
+func newLimiter(rate, burst float64) *limiter {
+	return &limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token for id. If none is available it returns how long until
+// one will be.
+func (l *limiter) allow(id string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if len(l.buckets) >= maxBuckets {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[id] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / l.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled, as they are no different from new
+// ones. If over half are still draining, as when many clients are limited at
+// once, so are the half idle longest, granting them a fresh burst rather than
+// letting the buckets grow without bound and be swept on every call.
+func (l *limiter) sweep(now time.Time) {
+	for id, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, id)
+		}
+	}
+
+	if len(l.buckets) < maxBuckets/2 {
+		return
+	}
+
+	last := make([]time.Time, 0, len(l.buckets))
+	for _, b := range l.buckets {
+		last = append(last, b.last)
+	}
+	sort.Slice(last, func(i, j int) bool {
+		return last[i].Before(last[j])
+	})
+
+	cutoff := last[len(last)/2]
+	for id, b := range l.buckets {
+		if !b.last.After(cutoff) {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+// limit reports whether the request may proceed under l, replying 429 Too Many
+// Requests with Retry-After if not.
+func limit(l *limiter, w http.ResponseWriter, r *http.Request) bool {
+	return limitKey(l, clientID(clientAddr(r)), w)
+}
+
+// limitKey is limit for a client known by id rather than its address.
+func limitKey(l *limiter, id string, w http.ResponseWriter) bool {
+	ok, wait := l.allow(id)
+	if ok {
+		return true
+	}
+
+	atomic.AddUint64(&metrics.limited, 1)
+
+	secs := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,172 @@
+package chat
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"time"
+)
+
+// lineChat joins the room name for the client at host, posting each line
+// returned by readLine and passing each new message in the room to writeLine,
+// until either fails or the room is pruned.
+func lineChat(name, host string, readLine func() (string, error),
+	writeLine func(string) error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	id := clientID(host)
+
+	if name == "" || len(name) > maxNameLen || !validName.MatchString(name) {
+		_ = writeLine("bad name")
+		return
+	}
+
+	lock.Lock()
+	pruneRooms()
+	name, _ = resolve(name)
+	_, exists := rooms[name]
+	err := errGeoBlocked
+	if !geoBlocked(host, !exists) {
+		err = createRoom(name)
+	}
+	lock.Unlock()
+
+	if err != nil {
+		_ = writeLine(err.Error())
+		return
+	}
+
+	streams.Add(1)
+	defer streams.Done()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			line, err := readLine()
+			if err != nil {
+				return
+			}
+
+			if geoBlocked(host, false) {
+				err = errGeoBlocked
+			} else {
+				lock.RLock()
+				to, _ := resolve(name)
+				lock.RUnlock()
+				_, err = addMsg(to, line, id)
+			}
+
+			switch {
+			case err == errHeld:
+				err = writeLine(err.Error())
+			case err != nil:
+				err = writeLine("error: " + err.Error())
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var seen uint64
+	cur := name
+	stopping := false
+
+	sub := watch(cur)
+	defer sub.stop()
+
+	for {
+		var lines []string
+
+		lock.RLock()
+		rm, ok := rooms[cur]
+		if !ok {
+			if to, moved := resolve(cur); moved {
+				cur = to
+				sub.follow(to)
+				lock.RUnlock()
+				continue
+			}
+			lock.RUnlock()
+			_ = writeLine("room expired")
+			return
+		}
+		rm.mu.Lock()
+		for i := rm.msgs.Len() - 1; i >= 0; i-- {
+			if m := rm.msgs.At(i); m.seq > seen {
+				lines = append(lines, m.String())
+			}
+		}
+		seen = rm.seq
+		rm.unlock()
+
+		for _, line := range lines {
+			if writeLine(line) != nil {
+				return
+			}
+		}
+
+		// One last pass delivers msgs posted before shutdown, then the
+		// notice.
+		if stopping {
+			if noticeShutdown() {
+				_ = writeLine("notice: " + shutdownNotice)
+			}
+			return
+		}
+
+		select {
+		case <-sub.c:
+		case <-done:
+			return
+		case <-shutdown:
+			stopping = true
+		}
+	}
+}
+
+// lineConn serves a telnet-style session over c: the first line names the
+// room to join, and the rest are messages.
+func lineConn(c net.Conn) {
+	defer c.Close()
+
+	write := func(s string) error {
+		deadline := time.Now().Add(10 * time.Second)
+		if err := c.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+		_, err := c.Write([]byte(s))
+		return err
+	}
+
+	// A msg of maxMsgLen runes takes up to 4 bytes each, and its line
+	// ends with CRLF.
+	sc := bufio.NewScanner(c)
+	sc.Buffer(make([]byte, 0, 256), 4*maxMsgLen+2)
+
+	readLine := func() (string, error) {
+		if !sc.Scan() {
+			if err := sc.Err(); err != nil {
+				return "", err
+			}
+			return "", net.ErrClosed
+		}
+		return sc.Text(), nil
+	}
+
+	if write("room: ") != nil {
+		return
+	}
+
+	name, err := readLine()
+	if err != nil {
+		return
+	}
+
+	lineChat(name, remoteHost(c), readLine,
+		func(s string) error {
+			return write(s + "\r\n")
+		})
+}
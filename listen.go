@@ -0,0 +1,225 @@
+package chat
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// listenFDsStart is the first descriptor passed by socket activation,
+	// or by the process upgraded from.
+	listenFDsStart = 3
+
+	// upgradeEnv lists the addresses of the sockets handed over on
+	// upgrade, in the order of their descriptors, and readyEnv is the
+	// descriptor to write to once serving.
+	upgradeEnv = "CHAT_UPGRADE_SOCKETS"
+	readyEnv   = "CHAT_UPGRADE_READY"
+)
+
+// socketMode is the permissions of unix sockets opened by openListener.
+var socketMode os.FileMode = 0660
+
+// socket is a listener or packet conn of this process, by the address it
+// was opened on.
+type socket struct {
+	addr string
+	conn filer
+}
+
+// filer is a socket whose descriptor can be duplicated.
+type filer interface {
+	File() (*os.File, error)
+}
+
+var (
+	// sockets are handed over to the new process on upgrade.
+	sockets []socket
+
+	// inherited are the sockets handed over by the process upgraded
+	// from, by address, and readyFile tells it once they are served.
+	inherited = make(map[string]*os.File)
+	readyFile *os.File
+)
+
+// inherit takes the sockets handed over by the process upgraded from, if
+// any. The variables naming them are cleared, so they are not passed on
+// again.
+func inherit() error {
+	names := os.Getenv(upgradeEnv)
+	if names == "" {
+		return nil
+	}
+
+	fd, err := strconv.Atoi(os.Getenv(readyEnv))
+	if err != nil {
+		return fmt.Errorf("%s: %v", readyEnv, err)
+	}
+	readyFile = os.NewFile(uintptr(fd), "ready")
+
+	for i, addr := range strings.Split(names, ",") {
+		inherited[addr] = os.NewFile(uintptr(listenFDsStart+i), addr)
+	}
+
+	if err = os.Unsetenv(upgradeEnv); err != nil {
+		return err
+	}
+	return os.Unsetenv(readyEnv)
+}
+
+// ready tells the process upgraded from, if any, that this one now serves
+// in its place. Sockets handed over but not opened again, as their flags
+// changed, are closed.
+func ready() {
+	for addr, f := range inherited {
+		f.Close()
+		delete(inherited, addr)
+	}
+
+	if readyFile == nil {
+		return
+	}
+	_, _ = readyFile.Write([]byte{1})
+	readyFile.Close()
+}
+
+// openListener opens a listener on addr, a TCP address or unix:/path for a
+// unix socket, or takes the one handed over for it. Sockets get the
+// permissions of socketMode, and replace any left behind by a previous run.
+func openListener(addr string) (net.Listener, error) {
+	ln, err := inheritListener(addr)
+	if ln == nil && err == nil {
+		ln, err = listenOn(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	track(addr, ln)
+	return ln, nil
+}
+
+// track adds c to the sockets handed over on upgrade, under addr.
+func track(addr string, c interface{}) {
+	if f, ok := c.(filer); ok {
+		sockets = append(sockets, socket{addr, f})
+	}
+}
+
+func inheritListener(addr string) (net.Listener, error) {
+	f, ok := inherited[addr]
+	if !ok {
+		return nil, nil
+	}
+	delete(inherited, addr)
+	defer f.Close()
+
+	// FileListener duplicates the descriptor.
+	return net.FileListener(f)
+}
+
+func listenOn(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Chmod(path, socketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// openPacketConn opens a UDP socket on addr, or takes the one handed over
+// for it.
+func openPacketConn(addr string) (net.PacketConn, error) {
+	// Kept apart from the TCP listener of the same address.
+	name := "udp:" + addr
+
+	var pc net.PacketConn
+	var err error
+	if f, ok := inherited[name]; ok {
+		delete(inherited, name)
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		pc, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	track(name, pc)
+	return pc, nil
+}
+
+// activated returns the listeners passed by systemd socket activation, or
+// handed over as such by the process upgraded from, or none if the process
+// was started otherwise. The variables naming them are cleared, so they are
+// not passed on to children.
+func activated() ([]net.Listener, error) {
+	var lns []net.Listener
+
+	if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil {
+			return nil, fmt.Errorf("LISTEN_FDS: %v", err)
+		}
+
+		for _, v := range []string{"LISTEN_PID", "LISTEN_FDS",
+			"LISTEN_FDNAMES"} {
+			if err = os.Unsetenv(v); err != nil {
+				return nil, err
+			}
+		}
+
+		for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+			f := os.NewFile(uintptr(fd), "fd "+strconv.Itoa(fd))
+
+			// FileListener duplicates the descriptor.
+			ln, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("activated %s: %v",
+					f.Name(), err)
+			}
+			lns = append(lns, ln)
+		}
+	} else {
+		for i := 0; ; i++ {
+			ln, err := inheritListener(activatedName(i))
+			if err != nil {
+				return nil, err
+			}
+			if ln == nil {
+				break
+			}
+			lns = append(lns, ln)
+		}
+	}
+
+	for i, ln := range lns {
+		track(activatedName(i), ln)
+	}
+	return lns, nil
+}
+
+// activatedName is the name the i-th activated listener is handed over
+// under.
+func activatedName(i int) string {
+	return "activated:" + strconv.Itoa(i)
+}
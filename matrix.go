@@ -0,0 +1,330 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// matrixAlias prefixes the local part of the Matrix alias of each room:
+// room abc is #chat_abc:matrixDomain.
+const matrixAlias = "chat_"
+
+var (
+	// matrixHomeserver is the homeserver the application service talks
+	// to, e.g. https://matrix.example.com. Disabled if empty.
+	matrixHomeserver string
+	matrixDomain     string
+	matrixASToken    string
+	matrixHSToken    string
+
+	// matrixUser is the service's own user, the sender_localpart of its
+	// registration, whose events are not relayed back.
+	matrixUser string
+
+	// matrixRooms maps rooms to Matrix room IDs, and matrixIDs back.
+	// Both are guarded by the global lock.
+	matrixRooms = make(map[string]string)
+	matrixIDs   = make(map[string]string)
+
+	// Transaction IDs must be unique across restarts too.
+	matrixTxnPrefix = strconv.FormatInt(time.Now().UnixNano(), 36)
+	matrixTxn       uint64
+)
+
+// matrixCall calls the client-server API as the application service,
+// decoding the response into out if not nil.
+func matrixCall(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method,
+		strings.TrimSuffix(matrixHomeserver, "/")+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+matrixASToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("matrix: %s %s: %s", method, path, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// matrixRoom returns the room name of a Matrix alias for the bridge, or "".
+func matrixRoom(alias string) string {
+	local, domain, ok := strings.Cut(strings.TrimPrefix(alias, "#"), ":")
+	if !ok || !strings.HasPrefix(alias, "#"+matrixAlias) ||
+		domain != matrixDomain {
+		return ""
+	}
+
+	name := strings.TrimPrefix(local, matrixAlias)
+	if name == "" || len(name) > maxNameLen || !validName.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+// matrixHandler serves the application service API the homeserver calls:
+// alias queries, which create Matrix rooms for chat rooms on demand, and
+// transactions of events.
+func matrixHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth,
+		"Bearer ") {
+		token = auth[len("Bearer "):]
+	}
+	if subtle.ConstantTimeCompare([]byte(token),
+		[]byte(matrixHSToken)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errcode":"M_FORBIDDEN"}`)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1")
+
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(path, "/rooms/"):
+		alias, err := url.PathUnescape(strings.TrimPrefix(path,
+			"/rooms/"))
+		if err != nil {
+			alias = ""
+		}
+		matrixQueryAlias(alias, w)
+	case r.Method == "PUT" && strings.HasPrefix(path, "/transactions/"):
+		matrixTransaction(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errcode":"M_UNRECOGNIZED"}`)
+	}
+}
+
+func matrixQueryAlias(alias string, w http.ResponseWriter) {
+	name := matrixRoom(alias)
+
+	lock.Lock()
+	err := errBadMsg
+	if name != "" {
+		name, _ = resolve(name)
+		err = createRoom(name)
+	}
+	lock.Unlock()
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errcode":"M_NOT_FOUND"}`)
+		return
+	}
+
+	var created struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := matrixCall("POST", "/_matrix/client/v3/createRoom",
+		map[string]interface{}{
+			"room_alias_name": strings.TrimPrefix(
+				strings.SplitN(alias, ":", 2)[0], "#"),
+			"name":       name,
+			"topic":      "bridged chat room " + name,
+			"preset":     "public_chat",
+			"visibility": "public",
+		}, &created); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errcode":"M_NOT_FOUND"}`)
+		return
+	}
+
+	matrixBridge(name, created.RoomID)
+	fmt.Fprint(w, "{}")
+}
+
+// matrixBridge relays the room name to the Matrix room id from now on.
+func matrixBridge(name, id string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, ok := matrixRooms[name]; ok {
+		return
+	}
+
+	rm, ok := rooms[name]
+	if !ok {
+		return
+	}
+
+	matrixRooms[name], matrixIDs[id] = id, name
+
+	streams.Add(1)
+	go matrixFollow(name, id, rm.seq)
+}
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	RoomID  string `json:"room_id"`
+	Sender  string `json:"sender"`
+	Content struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+	} `json:"content"`
+}
+
+func matrixTransaction(w http.ResponseWriter, r *http.Request) {
+	var txn struct {
+		Events []matrixEvent `json:"events"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body,
+		1<<20)).Decode(&txn); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"errcode":"M_NOT_JSON"}`)
+		return
+	}
+
+	for _, ev := range txn.Events {
+		if ev.Type != "m.room.message" ||
+			ev.Content.MsgType != "m.text" || ev.Sender == matrixUser {
+			continue
+		}
+
+		lock.Lock()
+		name, ok := matrixIDs[ev.RoomID]
+		lock.Unlock()
+
+		if !ok {
+			name = matrixLookup(ev.RoomID)
+			if name == "" {
+				continue
+			}
+		}
+
+		_, err := addMsgFrom(name, ev.Content.Body, clientID("matrix:"+
+			ev.Sender), "matrix")
+
+		if err != nil && err != errHeld {
+			if err := matrixSend(ev.RoomID, "m.notice",
+				"not relayed: "+err.Error()); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	fmt.Fprint(w, "{}")
+}
+
+// matrixLookup finds the room bridged to a Matrix room the service has not
+// seen since it started, from the room's canonical alias.
+func matrixLookup(id string) string {
+	var alias struct {
+		Alias string `json:"alias"`
+	}
+	if err := matrixCall("GET", "/_matrix/client/v3/rooms/"+
+		url.PathEscape(id)+"/state/m.room.canonical_alias", nil,
+		&alias); err != nil {
+		return ""
+	}
+
+	name := matrixRoom(alias.Alias)
+	if name == "" {
+		return ""
+	}
+
+	lock.Lock()
+	err := createRoom(name)
+	lock.Unlock()
+	if err != nil {
+		return ""
+	}
+
+	matrixBridge(name, id)
+	return name
+}
+
+func matrixSend(id, msgtype, body string) error {
+	txn := matrixTxnPrefix + "." +
+		strconv.FormatUint(atomic.AddUint64(&matrixTxn, 1), 10)
+
+	return matrixCall("PUT", "/_matrix/client/v3/rooms/"+
+		url.PathEscape(id)+"/send/m.room.message/"+txn,
+		map[string]string{
+			"msgtype": msgtype,
+			"body":    body,
+		}, nil)
+}
+
+// matrixFollow relays new msgs in the room to Matrix, until the room is
+// pruned, as for line sessions.
+func matrixFollow(name, id string, seen uint64) {
+	defer streams.Done()
+
+	sub := watch(name)
+	defer sub.stop()
+
+	stopping := false
+
+	for {
+		var bodies []string
+
+		lock.Lock()
+		rm, ok := rooms[name]
+		if !ok {
+			delete(matrixRooms, name)
+			delete(matrixIDs, id)
+			lock.Unlock()
+			return
+		}
+		for i := rm.msgs.Len() - 1; i >= 0; i-- {
+			if m := rm.msgs.At(i); m.seq > seen && m.from != "matrix" {
+				bodies = append(bodies, html.UnescapeString(m.s))
+			}
+		}
+		seen = rm.seq
+		lock.Unlock()
+
+		for _, body := range bodies {
+			if err := matrixSend(id, "m.text", body); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if stopping {
+			return
+		}
+
+		select {
+		case <-sub.c:
+		case <-shutdown:
+			stopping = true
+		}
+	}
+}
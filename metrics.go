@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Counters, updated atomically and pushed to statsd as deltas.
+var metrics struct {
+	msgs         uint64
+	roomsCreated uint64
+	roomsPruned  uint64
+	requests     uint64
+	limited      uint64
+}
+
+func init() {
+	listen(func(e event) {
+		switch e := e.(type) {
+		case msgPosted:
+			atomic.AddUint64(&metrics.msgs, 1)
+		case roomCreated:
+			atomic.AddUint64(&metrics.roomsCreated, 1)
+		case roomsPruned:
+			// Purges are not counted as pruned.
+			if !e.purged {
+				atomic.AddUint64(&metrics.roomsPruned,
+					uint64(len(e.rooms)))
+			}
+		}
+	})
+}
+
+// statsd pushes metrics to a statsd (or dogstatsd) daemon over UDP.
+type statsd struct {
+	c      net.Conn
+	prefix string
+	tags   string // dogstatsd tags, e.g. "env:prod,host:a"
+}
+
+// newStatsd dials addr. The socket is connected up front so it can be used
+// from inside the sandbox.
+func newStatsd(addr, prefix, tags string) (*statsd, error) {
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsd{c: c, prefix: prefix, tags: tags}, nil
+}
+
+func (s *statsd) line(b *bytes.Buffer, name string, v interface{},
+	kind string) {
+	fmt.Fprintf(b, "%s%s:%v|%s", s.prefix, name, v, kind)
+	if s.tags != "" {
+		fmt.Fprintf(b, "|#%s", s.tags)
+	}
+	b.WriteByte('\n')
+}
+
+func (s *statsd) send(b *bytes.Buffer) {
+	// Losing a packet is fine, so errors are ignored.
+	_, _ = s.c.Write(b.Bytes())
+}
+
+// timing sends a single timer sample.
+func (s *statsd) timing(name string, d time.Duration) {
+	var b bytes.Buffer
+	s.line(&b, name, d.Milliseconds(), "ms")
+	s.send(&b)
+}
+
+// run flushes counters and gauges every interval, forever.
+func (s *statsd) run(interval time.Duration) {
+	counters := []struct {
+		name string
+		v    *uint64
+		last uint64
+	}{
+		{name: "msgs", v: &metrics.msgs},
+		{name: "rooms.created", v: &metrics.roomsCreated},
+		{name: "rooms.pruned", v: &metrics.roomsPruned},
+		{name: "http.requests", v: &metrics.requests},
+		{name: "http.limited", v: &metrics.limited},
+	}
+
+	for range time.Tick(interval) {
+		var b bytes.Buffer
+
+		for i := range counters {
+			v := atomic.LoadUint64(counters[i].v)
+			s.line(&b, counters[i].name, v-counters[i].last, "c")
+			counters[i].last = v
+		}
+
+		lock.RLock()
+		n := len(rooms)
+		lock.RUnlock()
+
+		s.line(&b, "rooms", n, "g")
+		s.send(&b)
+	}
+}
+
+// timeRequests counts requests and, if s is not nil, sends their latency.
+func timeRequests(s *statsd, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		atomic.AddUint64(&metrics.requests, 1)
+		if s != nil {
+			s.timing("http.latency", time.Since(start))
+		}
+	})
+}
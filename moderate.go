@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"time"
+)
+
+const maxModerateResp = 4096
+
+var (
+	// moderateURL is an operator's moderation service, which is asked
+	// about each msg before it is accepted. Disabled if empty.
+	moderateURL string
+
+	// moderateTimeout bounds each call, after which the msg is accepted,
+	// or refused if moderateFailClosed.
+	moderateTimeout    = 2 * time.Second
+	moderateFailClosed bool
+
+	moderateClient = &http.Client{}
+
+	errDenied      = errors.New("msg denied by moderation")
+	errModerateOff = errors.New("moderation unavailable")
+)
+
+// moderateReq is POSTed as JSON to moderateURL. Msg is the plain text.
+type moderateReq struct {
+	Room string `json:"room"`
+	Msg  string `json:"msg"`
+	ID   string `json:"id"`
+}
+
+// moderateResp is the service's decision: "allow", "deny", or "transform",
+// in which case Msg replaces the msg. Reason is shown on deny.
+type moderateResp struct {
+	Action string `json:"action"`
+	Msg    string `json:"msg"`
+	Reason string `json:"reason"`
+}
+
+// moderate asks the moderation service about the cleaned str, returning the
+// msg to store in its place. The global lock must not be held.
+func moderate(name, str, id string) (string, error) {
+	if moderateURL == "" || str == "" {
+		return str, nil
+	}
+
+	resp, err := callModerate(moderateReq{
+		Room: name,
+		Msg:  html.UnescapeString(str),
+		ID:   id,
+	})
+
+	if err != nil {
+		log.Printf("moderate %s: %v", name, err)
+		if moderateFailClosed {
+			return "", errModerateOff
+		}
+		return str, nil
+	}
+
+	switch resp.Action {
+	case "allow":
+		return str, nil
+	case "deny":
+		if resp.Reason != "" {
+			return "", fmt.Errorf("%w: %s", errDenied, resp.Reason)
+		}
+		return "", errDenied
+	case "transform":
+		return cleanMsg(resp.Msg)
+	}
+
+	log.Printf("moderate %s: bad action %q", name, resp.Action)
+	if moderateFailClosed {
+		return "", errModerateOff
+	}
+	return str, nil
+}
+
+func callModerate(req moderateReq) (*moderateResp, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		moderateTimeout)
+	defer cancel()
+
+	hreq, err := http.NewRequestWithContext(ctx, "POST", moderateURL,
+		bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	hresp, err := moderateClient.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hresp.Body.Close()
+
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", hresp.Status)
+	}
+
+	var resp moderateResp
+	dec := json.NewDecoder(http.MaxBytesReader(nil, hresp.Body,
+		maxModerateResp))
+	if err := dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
@@ -0,0 +1,94 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Config configures a chat mounted with New.
+type Config struct {
+	// Prefix is the path the handler is mounted under, e.g. "/chat".
+	// Requests must keep the prefix, which the handler strips itself.
+	Prefix string
+
+	// NoJS serves rooms without JavaScript; readers refresh manually.
+	NoJS bool
+
+	// AdminToken enables /admin for requests bearing it. Admin
+	// endpoints are disabled if empty.
+	AdminToken string
+
+	// Store keeps the rooms across restarts. If nil they are kept in
+	// memory only.
+	Store Store
+
+	// Hooks are called in order as msgs are posted and rooms come and
+	// go, each implementing any of BeforePostHook, AfterPostHook,
+	// RoomCreateHook and PruneHook.
+	//
+	// BeforePost runs before the msg is posted, with no lock held, so it
+	// may take its time, e.g. to ask a spam filter. The others
+	// run with the server's lock held: AfterPost for reading, along with
+	// the room posted to, and OnRoomCreate and OnPrune for writing. They
+	// must be quick and must not call back into the server.
+	Hooks []interface{}
+}
+
+var (
+	// mounted is set once New or Main has set up the package's chat.
+	// Guarded by the global lock.
+	mounted bool
+
+	errMounted = errors.New("chat: New called twice")
+)
+
+// New returns a handler serving the rooms and pages of a chat, for mounting
+// in another server:
+//
+//	h, err := chat.New(chat.Config{Prefix: "/chat"})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	http.Handle("/chat/", h)
+//
+// Rooms and settings are kept in the package, so there is one chat per
+// process: New may be called only once, and not alongside Main. The other
+// frontends (gopher, IRC, SSH, ...) are only served by Main.
+func New(c Config) (http.Handler, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if mounted {
+		return nil, errMounted
+	}
+	mounted = true
+
+	prefix = strings.TrimSuffix(c.Prefix, "/")
+	nojs = c.NoJS
+	adminToken = c.AdminToken
+	plugins = c.Hooks
+
+	if c.Store != nil {
+		store = c.Store
+	}
+	if err := loadRooms(); err != nil {
+		return nil, fmt.Errorf("store: load: %w", err)
+	}
+	go pruneLoop()
+
+	mux := compress(routes())
+	if prefix == "" {
+		return mux, nil
+	}
+
+	h := http.StripPrefix(prefix, mux)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}), nil
+}
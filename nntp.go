@@ -0,0 +1,402 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nntpPrefix makes newsgroup names of rooms: room abc is chat.abc.
+const nntpPrefix = "chat."
+
+// nntpSession is a read-only NNTP (RFC 3977) session. Each room is a
+// newsgroup, and each msg an article numbered by its sequence number.
+type nntpSession struct {
+	w     *bufio.Writer
+	group string // selected room
+	cur   uint64 // current article number
+}
+
+// nntpConn serves an NNTP session over c.
+func nntpConn(c net.Conn) {
+	defer c.Close()
+
+	ns := &nntpSession{w: bufio.NewWriter(c)}
+	sc := bufio.NewScanner(c)
+	sc.Buffer(make([]byte, 0, 512), 512)
+
+	ns.line("201 chat NNTP service ready, posting prohibited")
+
+	for {
+		if err := c.SetWriteDeadline(time.Now().Add(
+			10 * time.Second)); err != nil {
+			return
+		}
+		if ns.w.Flush() != nil {
+			return
+		}
+
+		if err := c.SetReadDeadline(time.Now().Add(
+			10 * time.Minute)); err != nil {
+			return
+		}
+		if !sc.Scan() {
+			return
+		}
+
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		cmd, args := strings.ToUpper(fields[0]), fields[1:]
+		if cmd == "QUIT" {
+			ns.line("205 bye")
+			_ = ns.w.Flush()
+			return
+		}
+
+		lock.Lock()
+		ns.command(cmd, args)
+		lock.Unlock()
+	}
+}
+
+func (ns *nntpSession) line(format string, a ...interface{}) {
+	fmt.Fprintf(ns.w, format+"\r\n", a...)
+}
+
+// text writes a multi-line block, dot-stuffed and terminated.
+func (ns *nntpSession) text(lines []string) {
+	for _, l := range lines {
+		if strings.HasPrefix(l, ".") {
+			l = "." + l
+		}
+		ns.line("%s", l)
+	}
+	ns.line(".")
+}
+
+// nntpGroup returns the room of a newsgroup name, or "".
+func nntpGroup(group string) string {
+	group = strings.ToLower(group)
+	if !strings.HasPrefix(group, nntpPrefix) {
+		return ""
+	}
+
+	name := strings.TrimPrefix(group, nntpPrefix)
+	if len(name) > maxNameLen || !validName.MatchString(name) {
+		return ""
+	}
+	if _, ok := rooms[name]; !ok {
+		return ""
+	}
+	return name
+}
+
+// nntpBounds returns the lowest and highest article numbers of rm.
+func nntpBounds(rm *room) (uint64, uint64) {
+	if rm.msgs.Len() == 0 {
+		return rm.seq + 1, rm.seq
+	}
+	return rm.msgs.At(rm.msgs.Len() - 1).seq, rm.msgs.At(0).seq
+}
+
+func nntpFind(rm *room, seq uint64) (msg, bool) {
+	for i := 0; i < rm.msgs.Len(); i++ {
+		if m := rm.msgs.At(i); m.seq == seq {
+			return m, true
+		}
+	}
+	return msg{}, false
+}
+
+func nntpMsgID(name string, m msg) string {
+	return fmt.Sprintf("<%d.%d.%s@chat>", m.seq, m.at.UnixNano(), name)
+}
+
+// nntpByID finds the msg with a Message-ID from nntpMsgID.
+func nntpByID(id string) (string, msg, bool) {
+	id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), "@chat>")
+	parts := strings.SplitN(id, ".", 3)
+	if len(parts) != 3 {
+		return "", msg{}, false
+	}
+
+	seq, err1 := strconv.ParseUint(parts[0], 10, 64)
+	nano, err2 := strconv.ParseInt(parts[1], 10, 64)
+	rm, ok := rooms[parts[2]]
+	if err1 != nil || err2 != nil || !ok {
+		return "", msg{}, false
+	}
+
+	m, ok := nntpFind(rm, seq)
+	if !ok || m.at.UnixNano() != nano {
+		return "", msg{}, false
+	}
+	return parts[2], m, true
+}
+
+func nntpSubject(m msg) string {
+	s := []rune(html.UnescapeString(m.s))
+	if len(s) > 40 {
+		return string(s[:40]) + "..."
+	}
+	return string(s)
+}
+
+func (ns *nntpSession) head(name string, m msg) []string {
+	return []string{
+		"Path: chat",
+		"From: anon <anon@invalid>",
+		"Newsgroups: " + nntpPrefix + name,
+		"Subject: " + nntpSubject(m),
+		"Date: " + m.at.Format(time.RFC1123Z),
+		"Message-ID: " + nntpMsgID(name, m),
+		"Content-Type: text/plain; charset=utf-8",
+	}
+}
+
+func (ns *nntpSession) command(cmd string, args []string) {
+	switch cmd {
+	case "CAPABILITIES":
+		ns.line("101 capability list follows")
+		ns.text([]string{"VERSION 2", "READER", "LIST ACTIVE NEWSGROUPS",
+			"OVER"})
+	case "MODE":
+		ns.line("201 posting prohibited")
+	case "DATE":
+		ns.line("111 %s", time.Now().UTC().Format("20060102150405"))
+	case "HELP":
+		ns.line("100 help text follows")
+		ns.text([]string{"read-only: rooms are groups " + nntpPrefix +
+			"name"})
+	case "LIST":
+		ns.list(args)
+	case "NEWGROUPS":
+		ns.line("231 list of new newsgroups follows")
+		ns.text(nil)
+	case "NEWNEWS":
+		ns.line("230 list of new articles follows")
+		ns.text(nil)
+	case "GROUP", "LISTGROUP":
+		ns.selectGroup(cmd, args)
+	case "ARTICLE", "HEAD", "BODY", "STAT":
+		ns.article(cmd, args)
+	case "NEXT", "LAST":
+		ns.step(cmd == "NEXT")
+	case "OVER", "XOVER":
+		ns.over(args)
+	case "POST", "IHAVE":
+		ns.line("440 posting not permitted")
+	default:
+		ns.line("500 unknown command")
+	}
+}
+
+func (ns *nntpSession) list(args []string) {
+	kind := "ACTIVE"
+	if len(args) > 0 {
+		kind = strings.ToUpper(args[0])
+	}
+
+	names := make([]string, 0, len(rooms))
+	for name := range rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		switch kind {
+		case "ACTIVE":
+			lo, hi := nntpBounds(rooms[name])
+			lines = append(lines, fmt.Sprintf("%s%s %d %d n",
+				nntpPrefix, name, hi, lo))
+		case "NEWSGROUPS":
+			lines = append(lines, fmt.Sprintf("%s%s\tchat room %s",
+				nntpPrefix, name, name))
+		default:
+			ns.line("503 list type not supported")
+			return
+		}
+	}
+
+	ns.line("215 list follows")
+	ns.text(lines)
+}
+
+func (ns *nntpSession) selectGroup(cmd string, args []string) {
+	group := ns.group
+	if len(args) > 0 {
+		group = nntpGroup(args[0])
+	} else if group == "" {
+		ns.line("412 no newsgroup selected")
+		return
+	}
+
+	rm, ok := rooms[group]
+	if group == "" || !ok {
+		ns.line("411 no such newsgroup")
+		return
+	}
+
+	lo, hi := nntpBounds(rm)
+	ns.group, ns.cur = group, lo
+	if rm.msgs.Len() == 0 {
+		ns.cur = 0
+	}
+
+	ns.line("211 %d %d %d %s%s", rm.msgs.Len(), lo, hi, nntpPrefix, group)
+
+	if cmd == "LISTGROUP" {
+		lines := make([]string, 0, rm.msgs.Len())
+		for i := rm.msgs.Len() - 1; i >= 0; i-- {
+			lines = append(lines,
+				strconv.FormatUint(rm.msgs.At(i).seq, 10))
+		}
+		ns.text(lines)
+	}
+}
+
+func (ns *nntpSession) article(cmd string, args []string) {
+	var (
+		name = ns.group
+		m    msg
+		ok   bool
+		num  uint64
+	)
+
+	switch {
+	case len(args) > 0 && strings.HasPrefix(args[0], "<"):
+		if name, m, ok = nntpByID(args[0]); !ok {
+			ns.line("430 no such article")
+			return
+		}
+	case ns.group == "":
+		ns.line("412 no newsgroup selected")
+		return
+	default:
+		num = ns.cur
+		if len(args) > 0 {
+			n, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				ns.line("501 bad article number")
+				return
+			}
+			num = n
+		}
+		if m, ok = nntpFind(rooms[ns.group], num); !ok {
+			ns.line("423 no such article")
+			return
+		}
+		ns.cur = num
+	}
+
+	id := nntpMsgID(name, m)
+
+	switch cmd {
+	case "ARTICLE":
+		ns.line("220 %d %s", num, id)
+		ns.text(append(append(ns.head(name, m), ""),
+			html.UnescapeString(m.s)))
+	case "HEAD":
+		ns.line("221 %d %s", num, id)
+		ns.text(ns.head(name, m))
+	case "BODY":
+		ns.line("222 %d %s", num, id)
+		ns.text([]string{html.UnescapeString(m.s)})
+	case "STAT":
+		ns.line("223 %d %s", num, id)
+	}
+}
+
+func (ns *nntpSession) step(next bool) {
+	if ns.group == "" {
+		ns.line("412 no newsgroup selected")
+		return
+	}
+
+	rm := rooms[ns.group]
+	if _, ok := nntpFind(rm, ns.cur); !ok {
+		ns.line("420 no current article")
+		return
+	}
+
+	// msgs are newest first.
+	for i := 0; i < rm.msgs.Len(); i++ {
+		if rm.msgs.At(i).seq != ns.cur {
+			continue
+		}
+		j := i + 1
+		if next {
+			j = i - 1
+		}
+		if j < 0 || j >= rm.msgs.Len() {
+			if next {
+				ns.line("421 no next article")
+			} else {
+				ns.line("422 no previous article")
+			}
+			return
+		}
+		ns.cur = rm.msgs.At(j).seq
+		ns.line("223 %d %s", ns.cur, nntpMsgID(ns.group, rm.msgs.At(j)))
+		return
+	}
+}
+
+func (ns *nntpSession) over(args []string) {
+	if ns.group == "" {
+		ns.line("412 no newsgroup selected")
+		return
+	}
+
+	rm := rooms[ns.group]
+	lo, hi := ns.cur, ns.cur
+	if len(args) > 0 {
+		from, to, dash := strings.Cut(args[0], "-")
+		var err error
+		if lo, err = strconv.ParseUint(from, 10, 64); err != nil {
+			ns.line("501 bad range")
+			return
+		}
+		hi = lo
+		if dash {
+			hi = ^uint64(0)
+			if to != "" {
+				if hi, err = strconv.ParseUint(to, 10,
+					64); err != nil {
+					ns.line("501 bad range")
+					return
+				}
+			}
+		}
+	}
+
+	var lines []string
+	for i := rm.msgs.Len() - 1; i >= 0; i-- {
+		m := rm.msgs.At(i)
+		if m.seq < lo || m.seq > hi {
+			continue
+		}
+		body := html.UnescapeString(m.s)
+		lines = append(lines, fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t\t%d\t1",
+			m.seq, nntpSubject(m), "anon <anon@invalid>",
+			m.at.Format(time.RFC1123Z), nntpMsgID(ns.group, m),
+			len(body)))
+	}
+
+	if len(lines) == 0 {
+		ns.line("423 no articles in that range")
+		return
+	}
+
+	ns.line("224 overview information follows")
+	ns.text(lines)
+}
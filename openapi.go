@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema describes t as an OpenAPI schema, following its json tags.
+func schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{
+			"type":   "string",
+			"format": "date-time",
+		}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schema(t.Elem()),
+		}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schema(t.Elem()),
+		}
+	case t.Kind() == reflect.Struct:
+		props := make(map[string]interface{})
+		var required []string
+
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := strings.Split(f.Tag.Get("json"), ",")
+			if tag[0] == "-" || f.PkgPath != "" {
+				continue
+			}
+
+			name := f.Name
+			if tag[0] != "" {
+				name = tag[0]
+			}
+			props[name] = schema(f.Type)
+
+			if len(tag) < 2 || tag[1] != "omitempty" {
+				required = append(required, name)
+			}
+		}
+
+		s := map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+		}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+
+	return map[string]interface{}{}
+}
+
+func jsonContent(v interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": schema(reflect.TypeOf(v)),
+		},
+	}
+}
+
+// openAPI builds the OpenAPI 3 description of apiRoutes.
+func openAPI() map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+
+	for _, rt := range apiRoutes {
+		var params []interface{}
+		if strings.Contains(rt.path, "{name}") {
+			params = append(params, map[string]interface{}{
+				"name":     "name",
+				"in":       "path",
+				"required": true,
+				"schema": map[string]interface{}{
+					"type":      "string",
+					"pattern":   validName.String(),
+					"maxLength": maxNameLen,
+				},
+			})
+		}
+		for _, q := range rt.query {
+			params = append(params, map[string]interface{}{
+				"name":   q,
+				"in":     "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+
+		op := map[string]interface{}{
+			"summary": rt.summary,
+			"responses": map[string]interface{}{
+				strconv.Itoa(rt.code): map[string]interface{}{
+					"description": http.StatusText(rt.code),
+					"content":     jsonContent(rt.resp),
+				},
+				"default": map[string]interface{}{
+					"description": "error",
+					"content": jsonContent(
+						map[string]string{}),
+				},
+			},
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if rt.body != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(rt.body),
+			}
+		}
+
+		if paths[rt.path] == nil {
+			paths[rt.path] = make(map[string]interface{})
+		}
+		paths[rt.path][strings.ToLower(rt.method)] = op
+	}
+
+	v := version
+	if v == "" {
+		v = "devel"
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "chat",
+			"version": v,
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": prefix + "/api/v1"},
+		},
+		"paths": paths,
+	}
+}
@@ -0,0 +1,87 @@
+package chat
+
+import "html"
+
+// BeforePostHook may check or change each msg before it is posted, by
+// returning different text or an error refusing it, which the poster is
+// shown. text is the plain text of the msg. No lock is held.
+type BeforePostHook interface {
+	BeforePost(room, text string) (string, error)
+}
+
+// AfterPostHook is told of each msg posted, with the server's lock held for
+// reading and the room locked.
+type AfterPostHook interface {
+	AfterPost(room string, m Message)
+}
+
+// RoomCreateHook is told of each room created, with the server's lock held
+// for writing.
+type RoomCreateHook interface {
+	OnRoomCreate(room string)
+}
+
+// PruneHook is told of rooms deleted, whether expired or purged, with the
+// server's lock held for writing.
+type PruneHook interface {
+	OnPrune(rooms []string)
+}
+
+// plugins are the hooks of Config.Hooks, each implementing any of the hook
+// interfaces. Guarded by the global lock.
+var plugins []interface{}
+
+// beforePost runs the BeforePost hooks on the cleaned str. The global lock
+// must not be held, and is not held while the hooks run.
+func beforePost(name, str string) (string, error) {
+	lock.RLock()
+	ps := plugins
+	lock.RUnlock()
+
+	for _, p := range ps {
+		h, ok := p.(BeforePostHook)
+		if !ok || str == "" {
+			continue
+		}
+
+		text := html.UnescapeString(str)
+		out, err := h.BeforePost(name, text)
+		if err != nil {
+			return "", err
+		}
+		if out != text {
+			if str, err = cleanMsg(out); err != nil {
+				return "", err
+			}
+		}
+	}
+	return str, nil
+}
+
+func init() {
+	listen(func(e event) {
+		switch e := e.(type) {
+		case msgPosted:
+			for _, p := range plugins {
+				if h, ok := p.(AfterPostHook); ok {
+					h.AfterPost(e.room, e.msg)
+				}
+			}
+		case roomCreated:
+			for _, p := range plugins {
+				if h, ok := p.(RoomCreateHook); ok {
+					h.OnRoomCreate(e.room)
+				}
+			}
+		case roomsPruned:
+			if len(e.rooms) == 0 {
+				break
+			}
+			for _, p := range plugins {
+				if h, ok := p.(PruneHook); ok {
+					h.OnPrune(e.rooms)
+				}
+			}
+		}
+	})
+}
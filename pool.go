@@ -0,0 +1,29 @@
+package chat
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBuf bounds the buffers kept for reuse, so one huge response does
+// not pin its buffer forever.
+const maxPooledBuf = 64 << 10
+
+// bufs are reused to render responses, which are then written at once.
+var bufs = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuf() *bytes.Buffer {
+	b := bufs.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+func putBuf(b *bytes.Buffer) {
+	if b.Cap() <= maxPooledBuf {
+		bufs.Put(b)
+	}
+}
@@ -0,0 +1,221 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	// Registers the "postgres" driver.
+	_ "github.com/lib/pq"
+)
+
+const (
+	pgTimeout = 2 * time.Second
+
+	// pgCleanInterval is how often msgs of pruned rooms, and msgs past
+	// maxMsgsCount, are deleted.
+	pgCleanInterval = time.Hour
+)
+
+// Rooms get a new id each time they are created, so msgs left behind by a
+// pruned room until the cleanup job runs are never seen by a new room of the
+// same name. The primary key on chat_msgs is the (room, seq) index appends
+// and lists use.
+const pgSchema = `
+CREATE TABLE IF NOT EXISTS chat_rooms (
+	id bigserial PRIMARY KEY,
+	name text NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS chat_msgs (
+	room bigint NOT NULL,
+	seq bigint NOT NULL,
+	at timestamptz NOT NULL,
+	html text NOT NULL,
+	PRIMARY KEY (room, seq)
+);`
+
+// pgStore keeps rooms in PostgreSQL, for deployments that already run it
+// and want rooms in their backups. Pruning a room only deletes its row; its
+// msgs are deleted in the background by clean.
+type pgStore struct {
+	db *sql.DB
+
+	create, add, list, prune, rooms *sql.Stmt
+}
+
+func openPGStore(dsn string) (*pgStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(8)
+	db.SetMaxIdleConns(4)
+	db.SetConnMaxLifetime(30 * time.Minute)
+
+	s := &pgStore{db: db}
+	if err := s.prepare(); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+
+	go s.clean()
+
+	return s, nil
+}
+
+func (s *pgStore) prepare() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*pgTimeout)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, pgSchema); err != nil {
+		return err
+	}
+
+	for _, st := range []struct {
+		dst   **sql.Stmt
+		query string
+	}{
+		{&s.create, `INSERT INTO chat_rooms (name) VALUES ($1)
+			ON CONFLICT (name) DO NOTHING`},
+		{&s.add, `INSERT INTO chat_msgs (room, seq, at, html)
+			SELECT id, $2::bigint, $3::timestamptz, $4::text
+			FROM chat_rooms WHERE name = $1
+			ON CONFLICT (room, seq) DO UPDATE
+			SET at = excluded.at, html = excluded.html`},
+		{&s.list, `SELECT m.seq, m.at, m.html
+			FROM chat_msgs m JOIN chat_rooms r ON m.room = r.id
+			WHERE r.name = $1 ORDER BY m.seq DESC LIMIT $2`},
+		{&s.prune, `DELETE FROM chat_rooms WHERE name = $1`},
+		{&s.rooms, `SELECT name FROM chat_rooms`},
+	} {
+		var err error
+		if *st.dst, err = s.db.PrepareContext(ctx, st.query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clean deletes orphaned and excess msgs every pgCleanInterval, forever.
+func (s *pgStore) clean() {
+	for range time.Tick(pgCleanInterval) {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Minute)
+
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM chat_msgs m
+			WHERE NOT EXISTS (
+				SELECT 1 FROM chat_rooms r WHERE r.id = m.room
+			)`); err != nil {
+			log.Printf("store: clean: %v", err)
+		}
+
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM chat_msgs
+			WHERE (room, seq) IN (
+				SELECT room, seq FROM (
+					SELECT room, seq, row_number() OVER (
+						PARTITION BY room ORDER BY seq DESC
+					) AS n FROM chat_msgs
+				) ranked WHERE n > $1
+			)`, maxMsgsCount); err != nil {
+			log.Printf("store: clean: %v", err)
+		}
+
+		cancel()
+	}
+}
+
+func (s *pgStore) Close() error {
+	for _, st := range []*sql.Stmt{s.create, s.add, s.list, s.prune,
+		s.rooms} {
+		if st != nil {
+			_ = st.Close()
+		}
+	}
+	return s.db.Close()
+}
+
+func (s *pgStore) CreateRoom(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+
+	_, err := s.create.ExecContext(ctx, name)
+	return err
+}
+
+func (s *pgStore) AppendMessage(name string, m Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+
+	_, err := s.add.ExecContext(ctx, name, int64(m.Seq), m.Time,
+		m.HTML)
+	return err
+}
+
+func (s *pgStore) Messages(name string) ([]Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+
+	rows, err := s.list.QueryContext(ctx, name, maxMsgsCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []Message
+	for rows.Next() {
+		var m Message
+		var seq int64
+		if err := rows.Scan(&seq, &m.Time, &m.HTML); err != nil {
+			return nil, err
+		}
+		m.Seq, m.Time = uint64(seq), m.Time.UTC()
+		msgs = append(msgs, m)
+	}
+
+	return msgs, rows.Err()
+}
+
+func (s *pgStore) Prune(names []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	prune := tx.StmtContext(ctx, s.prune)
+	for _, name := range names {
+		if _, err := prune.ExecContext(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *pgStore) ListRooms() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+
+	rows, err := s.rooms.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
@@ -0,0 +1,149 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxPending bounds the moderation queue of each room.
+const maxPending = 50
+
+var (
+	// premod holds every room's posts for approval.
+	premod bool
+
+	errHeld       = errors.New("msg held for moderation")
+	errQueueFull  = errors.New("moderation queue full")
+	errNoSuchRoom = errors.New("no such room")
+	errNoPending  = errors.New("no such pending msg")
+)
+
+// pending is a cleaned msg waiting for approval.
+type pending struct {
+	id   uint64
+	s    string
+	by   string
+	from string
+	at   time.Time
+}
+
+func held(rm *room) bool {
+	return premod || rm.premod
+}
+
+// submitMsg appends the cleaned str to the room as appendMsg does, or queues
+// it if the room is pre-moderated, in which case it returns errHeld. The
+// global lock must not be held.
+func submitMsg(name, str, id, from string) (uint64, error) {
+	if str == "" {
+		return 0, nil
+	}
+
+	rm, err := lockRoom(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if !held(rm) {
+		rm.unlock()
+		return appendMsg(name, str, id, from)
+	}
+	defer rm.unlock()
+
+	if len(rm.pending) >= maxPending {
+		return 0, errQueueFull
+	}
+
+	rm.pendingSeq++
+	rm.pending = append(rm.pending, pending{
+		id:   rm.pendingSeq,
+		s:    str,
+		by:   id,
+		from: from,
+		at:   time.Now().UTC(),
+	})
+
+	return 0, errHeld
+}
+
+// adminPending lists the queue of a room, oldest first.
+func adminPending(w http.ResponseWriter, r *http.Request) {
+	rm, ok := rooms[r.FormValue("room")]
+	if !ok {
+		http.Error(w, errNoSuchRoom.Error(), http.StatusNotFound)
+		return
+	}
+
+	for _, p := range rm.pending {
+		fmt.Fprintf(w, "%d %s: %s\n", p.id,
+			p.at.Format("2006-01-02 15:04"), p.s)
+	}
+}
+
+// adminModerate approves or rejects the pending msg "id" in "room". The
+// global lock is released while an approved msg is posted.
+func adminModerate(approve bool, w http.ResponseWriter, r *http.Request) {
+	name := r.PostFormValue("room")
+
+	rm, ok := rooms[name]
+	if !ok {
+		http.Error(w, errNoSuchRoom.Error(), http.StatusNotFound)
+		return
+	}
+
+	id, err := strconv.ParseUint(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+
+	for i, p := range rm.pending {
+		if p.id != id {
+			continue
+		}
+
+		rm.pending = append(rm.pending[:i:i], rm.pending[i+1:]...)
+
+		if !approve {
+			fmt.Fprintf(w, "rejected %d\n", id)
+			return
+		}
+
+		lock.Unlock()
+		_, err := appendMsg(name, p.s, p.by, p.from)
+		lock.Lock()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprintf(w, "approved %d\n", id)
+		return
+	}
+
+	http.Error(w, errNoPending.Error(), http.StatusNotFound)
+}
+
+// adminPremod turns pre-moderation of a room on or off.
+func adminPremod(w http.ResponseWriter, r *http.Request) {
+	name := r.PostFormValue("room")
+
+	if err := createRoom(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	on, err := strconv.ParseBool(r.PostFormValue("on"))
+	if err != nil {
+		http.Error(w, "bad on", http.StatusBadRequest)
+		return
+	}
+
+	rooms[name].premod = on
+
+	fmt.Fprintf(w, "premod %s: %t\n", name, on)
+}
@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the peers whose X-Forwarded-For and X-Real-IP headers
+// are believed. Headers from anyone else are ignored, since clients can set
+// them to anything.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or addresses.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+
+		if !strings.Contains(f, "/") {
+			if strings.Contains(f, ":") {
+				f += "/128"
+			} else {
+				f += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func trusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// viaSocket reports whether r came over a unix socket, whose peers are the
+// local proxies its permissions let in.
+func viaSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+// clientAddr returns the address of the client behind r. When the peer is a
+// trusted proxy, or connected over a unix socket, this is the rightmost
+// X-Forwarded-For entry that is not itself a trusted proxy, or else
+// X-Real-IP.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !trusted(host) && !viaSocket(r) {
+		return host
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			host = hop
+			if !trusted(hop) {
+				return hop
+			}
+		}
+
+		return host
+	}
+
+	xri := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	if net.ParseIP(xri) != nil {
+		return xri
+	}
+
+	return host
+}
+
+// remoteHost returns the host part of the address of the peer of c.
+func remoteHost(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+
+	return host
+}
@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyListener wraps a listener whose peers are all proxies speaking the
+// HAProxy PROXY protocol (v1 or v2), so that RemoteAddr reports the real
+// client. Connections without a valid header are closed.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn reads the PROXY header lazily, on the first call to Read or
+// RemoteAddr, so a slow proxy cannot stall Accept.
+type proxyConn struct {
+	net.Conn
+	r    *bufio.Reader
+	once sync.Once
+	addr net.Addr
+	err  error
+}
+
+var (
+	errProxyHeader = errors.New("proxy: bad header")
+	proxySig       = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		deadline := time.Now().Add(10 * time.Second)
+		if c.err = c.SetReadDeadline(deadline); c.err != nil {
+			return
+		}
+
+		if b, _ := c.r.Peek(len(proxySig)); bytes.Equal(b, proxySig) {
+			c.addr, c.err = readProxyV2(c.r)
+		} else {
+			c.addr, c.err = readProxyV1(c.r)
+		}
+
+		if c.err == nil {
+			c.err = c.SetReadDeadline(time.Time{})
+		}
+
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.addr != nil {
+		return c.addr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyV1 reads a text header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+
+	// A v1 header is at most 107 bytes including CRLF.
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	s := string(line)
+	if !strings.HasSuffix(s, "\r\n") {
+		return nil, errProxyHeader
+	}
+
+	f := strings.Fields(s)
+	if len(f) < 2 || f[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+
+	switch f[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(f) != 6 {
+			return nil, errProxyHeader
+		}
+	default:
+		return nil, errProxyHeader
+	}
+
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL commands (health checks from the proxy itself) carry no
+	// address.
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	}
+
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET: src, dst, sport, dport
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:])),
+		}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:])),
+		}, nil
+	default:
+		return nil, nil
+	}
+}
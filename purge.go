@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// purged counts the purges of each room name, so msgs scheduled for a room
+// before it was purged are dropped rather than posted to a new one.
+var purged = make(map[string]uint64)
+
+// purgeRoom deletes the room now, along with its stored and archived copies,
+// reporting whether it existed. Unlike pruning nothing is archived. The
+// global lock must be held for writing.
+func purgeRoom(name string) bool {
+	waitRooms(name)
+
+	rm, ok := rooms[name]
+	if ok {
+		delete(rooms, name)
+	}
+
+	purged[name]++
+	pruneStore([]string{name})
+	if ok {
+		emit(roomsPruned{
+			rooms:  []string{name},
+			rms:    []*room{rm},
+			purged: true,
+		})
+	}
+
+	if archiveDir != "" {
+		if err := os.RemoveAll(filepath.Join(archiveDir,
+			name)); err != nil {
+			log.Printf("purge: %v", err)
+		}
+	}
+	if archiveS3 != nil {
+		archiveS3.remove(name + "/")
+	}
+
+	return ok
+}
+
+// adminPurge deletes the room "room", or with "all" every room with no msgs
+// for "older-than" (default 0, every room), for takedowns that cannot wait
+// for the lifespan.
+func adminPurge(w http.ResponseWriter, r *http.Request) {
+	if name := r.PostFormValue("room"); name != "" {
+		if len(name) > maxNameLen || !validName.MatchString(name) {
+			http.Error(w, "bad name", http.StatusBadRequest)
+			return
+		}
+
+		to, _ := resolve(name)
+		if _, ok := rooms[to]; !ok {
+			http.Error(w, "no such room: "+name, http.StatusNotFound)
+			return
+		}
+
+		if err := mutate(raftEntry{
+			Op:    "purge",
+			Time:  time.Now().UTC(),
+			Names: []string{to},
+		}); err != nil {
+			http.Error(w, err.Error(), postStatus(err))
+			return
+		}
+		publishPurge(to)
+
+		fmt.Fprintf(w, "purged %s\n", to)
+		return
+	}
+
+	if r.PostFormValue("all") != "1" {
+		http.Error(w, "room or all required", http.StatusBadRequest)
+		return
+	}
+
+	var d time.Duration
+	if s := r.PostFormValue("older-than"); s != "" {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil || d < 0 {
+			http.Error(w, "bad older-than", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var names []string
+	for name, rm := range rooms {
+		if time.Now().UTC().Sub(rm.last) >= d {
+			names = append(names, name)
+		}
+	}
+
+	if err := mutate(raftEntry{
+		Op:    "purge",
+		Time:  time.Now().UTC(),
+		Names: names,
+	}); err != nil {
+		http.Error(w, err.Error(), postStatus(err))
+		return
+	}
+	for _, name := range names {
+		publishPurge(name)
+	}
+
+	fmt.Fprintf(w, "purged %d rooms\n", len(names))
+}
@@ -0,0 +1,349 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+const (
+	raftTimeout = 5 * time.Second
+
+	// raftSnapshots is how many snapshots of the rooms are kept on disk.
+	raftSnapshots = 2
+)
+
+// raftNode replicates the rooms between nodes, so every node serves them and
+// none loses a msg once its post succeeded. It is nil unless -raft-addr is
+// set.
+//
+// Every change to the rooms goes through the log, and only the leader
+// accepts them: posts, room creation, creator tokens, renames, merges,
+// prunes, purges and admin imports. Moderation state and the banner stay on
+// the node they were set on.
+var raftNode *raft.Raft
+
+var errNotLeader = errors.New("not the leader, post there instead")
+
+// raftEntry is one entry of the replicated log. Without Raft, changes to the
+// rooms take the same form, and are applied at once.
+type raftEntry struct {
+	Op      string               `json:"op"`
+	Room    string               `json:"room,omitempty"`
+	To      string               `json:"to,omitempty"`
+	ID      string               `json:"id,omitempty"`
+	From    string               `json:"from,omitempty"`
+	HTML    string               `json:"html,omitempty"`
+	Time    time.Time            `json:"time"`
+	Age     time.Duration        `json:"age,omitempty"`
+	Names   []string             `json:"names,omitempty"`
+	Creator []byte               `json:"creator,omitempty"`
+	State   map[string]roomState `json:"state,omitempty"`
+}
+
+// raftFSM applies the log to the rooms.
+type raftFSM struct{}
+
+// raftSnapshot is the rooms, in the form of /admin/state.
+type raftSnapshot map[string]roomState
+
+// openRaft starts this node of the cluster, keeping its log and snapshots in
+// dir. peers lists every node as id=addr, and is used to start a new cluster.
+func openRaft(id, addr, dir, peers string) (*raft.Raft, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(id)
+
+	advertise, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := raft.NewTCPTransport(addr, advertise, 3, raftTimeout,
+		os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	snaps, err := raft.NewFileSnapshotStore(dir, raftSnapshots, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := raft.NewRaft(conf, raftFSM{}, logs, logs, snaps, trans)
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []raft.Server
+	for _, p := range strings.Split(peers, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		i := strings.IndexByte(p, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("raft: peer %q not id=addr", p)
+		}
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(p[:i]),
+			Address: raft.ServerAddress(p[i+1:]),
+		})
+	}
+	if len(servers) == 0 {
+		servers = []raft.Server{{
+			ID:      conf.LocalID,
+			Address: trans.LocalAddr(),
+		}}
+	}
+
+	// Bootstrapping a node that already has state is refused, so every
+	// node may try it on every start.
+	err = r.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	if err != nil && err != raft.ErrCantBootstrap {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// raftFollower reports whether this node is in a cluster but not leading it.
+func raftFollower() bool {
+	return raftNode != nil && raftNode.State() != raft.Leader
+}
+
+// raftAppend posts str to the room through the log, returning once a quorum
+// has it, with its sequence number as appendMsg does. The global lock must not
+// be held, as applying the entry takes it.
+func raftAppend(name, str, id, from string) (uint64, error) {
+	v, err := raftResponse(raftEntry{
+		Op:   "msg",
+		Room: name,
+		ID:   id,
+		From: from,
+		HTML: str,
+		Time: time.Now().UTC(),
+	})
+	seq, _ := v.(uint64)
+	return seq, err
+}
+
+// raftApply appends e to the log, returning once a quorum has it, with the
+// error of applying it. The global lock must not be held.
+func raftApply(e raftEntry) error {
+	_, err := raftResponse(e)
+	return err
+}
+
+// raftResponse is raftApply, also returning what applying e returned if not
+// an error.
+func raftResponse(e raftEntry) (interface{}, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	f := raftNode.Apply(b, raftTimeout)
+	if err = f.Error(); err == raft.ErrNotLeader {
+		return nil, errNotLeader
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err, ok := f.Response().(error); ok {
+		return nil, err
+	}
+	return f.Response(), nil
+}
+
+// mutate changes the rooms as e describes, through the log with Raft, unless
+// upgrading. The global lock must be held for writing. With Raft it is
+// released until the entry is applied, so rooms may have changed otherwise
+// too once it returns.
+func mutate(e raftEntry) error {
+	if upgrading {
+		return errUpgrading
+	}
+
+	if raftNode == nil {
+		return e.apply()
+	}
+
+	lock.Unlock()
+	defer lock.Lock()
+
+	return raftApply(e)
+}
+
+// raftPrune prunes expired rooms through the log, if this node leads. The
+// global lock must be held.
+func raftPrune() {
+	names := expired(lifespan)
+	if len(names) == 0 || raftNode.State() != raft.Leader {
+		return
+	}
+
+	b, err := json.Marshal(raftEntry{
+		Op:    "prune",
+		Time:  time.Now().UTC(),
+		Age:   lifespan,
+		Names: names,
+	})
+	if err != nil {
+		log.Printf("raft: prune: %v", err)
+		return
+	}
+
+	// Applying the entry takes the global lock, so it is not waited for.
+	f := raftNode.Apply(b, raftTimeout)
+	go func() {
+		if err := f.Error(); err != nil {
+			log.Printf("raft: prune: %v", err)
+		}
+	}()
+}
+
+// expired returns the rooms with no msgs for longer than d, unless msgs are
+// scheduled for them. The global lock must be held.
+func expired(d time.Duration) []string {
+	now := time.Now().UTC()
+
+	var names []string
+	for name, rm := range rooms {
+		if rm.scheduled == 0 && !rm.posting && now.Sub(rm.last) > d {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// apply makes the change e describes to this node's rooms. Other than msgs,
+// which are posted like any other, the global lock must be held for writing.
+func (e raftEntry) apply() error {
+	switch e.Op {
+	case "create":
+		return addRoom(e.Room, e.Time)
+	case "creator":
+		if rm, ok := rooms[e.Room]; ok && rm.creator == nil {
+			rm.creator = e.Creator
+		}
+	case "rename":
+		return renameRoom(e.Room, e.To, e.Time)
+	case "merge":
+		return mergeRooms(e.Room, e.To, e.Time)
+	case "prune":
+		pruneExpired(e.Names, e.Time, e.Age)
+	case "purge":
+		for _, name := range e.Names {
+			purgeRoom(name)
+		}
+	case "import":
+		return importRooms(e.State)
+	default:
+		return fmt.Errorf("unknown op %q", e.Op)
+	}
+
+	return nil
+}
+
+// pruneExpired prunes the named rooms still expired by age as of now, as
+// msgs may have been posted since they were chosen. Unlike expire, rooms
+// failing to archive are pruned anyway, so every node agrees on them. The
+// global lock must be held.
+func pruneExpired(names []string, now time.Time, age time.Duration) {
+	var pruned []string
+	var rms []*room
+	for _, name := range names {
+		rm, ok := rooms[name]
+		if !ok || now.Sub(rm.last) <= age {
+			continue
+		}
+
+		if err := archiveRoom(name, rm); err != nil {
+			log.Printf("archive: %v", err)
+		}
+
+		delete(rooms, name)
+		pruned = append(pruned, name)
+		rms = append(rms, rm)
+	}
+	emit(roomsPruned{rooms: pruned, rms: rms})
+}
+
+func (raftFSM) Apply(l *raft.Log) interface{} {
+	var e raftEntry
+	if err := json.Unmarshal(l.Data, &e); err != nil {
+		return err
+	}
+
+	if e.Op != "msg" {
+		lock.Lock()
+		defer lock.Unlock()
+		return e.apply()
+	}
+
+	// Entries are applied one at a time, so the room is still there when
+	// the msg is added.
+	lock.Lock()
+	err := addRoom(e.Room, e.Time)
+	lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// The leader answers the post with its sequence number.
+	seq, err := addToRoom(e.Room, e.HTML, e.ID, e.From, e.Time)
+	if err != nil {
+		return err
+	}
+	return seq
+}
+
+func (raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return raftSnapshot(snapshot()), nil
+}
+
+func (raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var state map[string]roomState
+	if err := json.NewDecoder(rc).Decode(&state); err != nil {
+		return err
+	}
+
+	lock.Lock()
+	restore(state)
+	lock.Unlock()
+
+	return nil
+}
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (raftSnapshot) Release() {}
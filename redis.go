@@ -0,0 +1,316 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// redisPoolSize is how many idle connections are kept for reuse.
+	redisPoolSize = 4
+
+	redisTimeout = time.Second
+
+	// redisRetry is how long Redis is left alone after it fails, so posts
+	// are not each held up by a dead server.
+	redisRetry = 10 * time.Second
+
+	// redisRooms is a sorted set of room names, scored by when they last
+	// changed; each room's msgs are in the list redisRoom+name, newest
+	// first.
+	redisRooms = "chat:rooms"
+	redisRoom  = "chat:room:"
+)
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+var errRedisDown = errors.New("redis: unavailable, retrying later")
+
+// redisStore keeps rooms in Redis, so they survive restarts and instances
+// behind a load balancer start from the same rooms. Keys expire after the
+// room lifespan, as rooms do.
+//
+// Redis being down must not take chat down with it: adds are never refused,
+// only logged, and rooms and msgs added meanwhile are kept in memory alone.
+type redisStore struct {
+	addr     string
+	password string
+	idle     chan *redisConn
+
+	mu       sync.Mutex
+	downTill time.Time
+}
+
+type redisConn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newRedisStore(addr, password string) *redisStore {
+	return &redisStore{
+		addr:     addr,
+		password: password,
+		idle:     make(chan *redisConn, redisPoolSize),
+	}
+}
+
+func (s *redisStore) dial() (*redisConn, error) {
+	c, err := net.DialTimeout("tcp", s.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+
+	if s.password != "" {
+		if _, err := rc.do([]string{"AUTH", s.password}); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+// do runs cmds in one round trip on a pooled connection, returning their
+// replies in order.
+func (s *redisStore) do(cmds ...[]string) ([]interface{}, error) {
+	s.mu.Lock()
+	down := time.Now().Before(s.downTill)
+	s.mu.Unlock()
+	if down {
+		return nil, errRedisDown
+	}
+
+	var rc *redisConn
+	select {
+	case rc = <-s.idle:
+	default:
+		var err error
+		if rc, err = s.dial(); err != nil {
+			s.fail()
+			return nil, err
+		}
+	}
+
+	replies, err := rc.do(cmds...)
+
+	var re redisError
+	if err != nil && !errors.As(err, &re) {
+		// The connection is in an unknown state.
+		rc.c.Close()
+		s.fail()
+		return nil, err
+	}
+
+	select {
+	case s.idle <- rc:
+	default:
+		rc.c.Close()
+	}
+
+	return replies, err
+}
+
+func (s *redisStore) fail() {
+	s.mu.Lock()
+	s.downTill = time.Now().Add(redisRetry)
+	s.mu.Unlock()
+}
+
+func (rc *redisConn) do(cmds ...[]string) ([]interface{}, error) {
+	if err := rc.c.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+
+	for _, args := range cmds {
+		fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(a), a)
+		}
+	}
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	// Every reply is read, even after an error reply, so the connection
+	// can be reused.
+	replies := make([]interface{}, len(cmds))
+	var first error
+	for i := range replies {
+		v, err := rc.reply()
+		if _, ok := err.(redisError); ok {
+			if first == nil {
+				first = err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		replies[i] = v
+	}
+
+	return replies, first
+}
+
+// reply reads a RESP reply: a string, int64, nil, or []interface{} of these.
+func (rc *redisConn) reply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: bad reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = rc.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+
+	return nil, errors.New("redis: bad reply")
+}
+
+// touch returns the commands marking the room as changed now.
+func (s *redisStore) touch(name string) [][]string {
+	now := time.Now()
+	return [][]string{
+		{"ZADD", redisRooms, strconv.FormatInt(now.Unix(), 10), name},
+		{"EXPIRE", redisRoom + name,
+			strconv.Itoa(int(lifespan.Seconds()))},
+	}
+}
+
+func (s *redisStore) CreateRoom(name string) error {
+	if _, err := s.do(s.touch(name)...); err != nil {
+		log.Printf("store: create %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *redisStore) AppendMessage(name string, m Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	cmds := [][]string{
+		{"LPUSH", redisRoom + name, string(b)},
+		{"LTRIM", redisRoom + name, "0", strconv.Itoa(maxMsgsCount - 1)},
+	}
+	if _, err := s.do(append(cmds, s.touch(name)...)...); err != nil {
+		log.Printf("store: append to %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *redisStore) Messages(name string) ([]Message, error) {
+	replies, err := s.do([]string{"LRANGE", redisRoom + name, "0", "-1"})
+	if err != nil {
+		return nil, err
+	}
+
+	list, _ := replies[0].([]interface{})
+	msgs := make([]Message, 0, len(list))
+	for _, v := range list {
+		str, _ := v.(string)
+
+		var m Message
+		if err := json.Unmarshal([]byte(str), &m); err != nil {
+			return nil, fmt.Errorf("redis: room %s: %w", name, err)
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+func (s *redisStore) Prune(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	del := []string{"DEL"}
+	zrem := []string{"ZREM", redisRooms}
+	for _, name := range names {
+		del = append(del, redisRoom+name)
+		zrem = append(zrem, name)
+	}
+
+	_, err := s.do(del, zrem)
+	return err
+}
+
+// ListRooms lists rooms changed within the lifespan, forgetting older ones.
+func (s *redisStore) ListRooms() ([]string, error) {
+	old := strconv.FormatInt(time.Now().Add(-lifespan).Unix(), 10)
+
+	replies, err := s.do(
+		[]string{"ZREMRANGEBYSCORE", redisRooms, "-inf", "(" + old},
+		[]string{"ZRANGE", redisRooms, "0", "-1"},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	list, _ := replies[1].([]interface{})
+	names := make([]string, 0, len(list))
+	for _, v := range list {
+		if name, ok := v.(string); ok {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+func (s *redisStore) Close() error {
+	for {
+		select {
+		case rc := <-s.idle:
+			rc.c.Close()
+		default:
+			return nil
+		}
+	}
+}
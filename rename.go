@@ -0,0 +1,222 @@
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// redirect points a renamed room at its new name until expires.
+type redirect struct {
+	to      string
+	expires time.Time
+}
+
+// redirects holds old room names, so links and open clients keep working
+// after a rename.
+var redirects = make(map[string]redirect)
+
+var errRoomExists = errors.New("room exists")
+
+const creatorCookie = "creator"
+
+const renameForm = `
+	<form action="%s/%s/rename" method="post" autocomplete="off">
+		<label>rename room: </label>
+		<input type="text" name="to" required maxlength="%d"
+			pattern="%s" title="letters">
+		<input type="submit" value="rename">
+	</form>`
+
+// resolve follows redirects from renamed rooms, reporting whether there were
+// any.
+func resolve(name string) (string, bool) {
+	moved := false
+
+	// Bounded, in case of a cycle through renames back to an old name.
+	for i := 0; i < 8; i++ {
+		rd, ok := redirects[name]
+		if !ok || time.Now().After(rd.expires) {
+			break
+		}
+		name, moved = rd.to, true
+	}
+
+	return name, moved
+}
+
+func pruneRedirects() {
+	now := time.Now()
+
+	for k, v := range redirects {
+		if now.After(v.expires) {
+			delete(redirects, k)
+		}
+	}
+}
+
+// setCreator sets the creator cookie for the room, which only its path can
+// see.
+func setCreator(name, token string, w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     creatorCookie,
+		Value:    token,
+		Path:     prefix + "/" + name,
+		MaxAge:   int(lifespan.Seconds()),
+		Secure:   hsts != "",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// issueCreator makes the client the creator of a newly created room. Only a
+// hash of the token is kept. The global lock must be held for writing, and
+// with Raft is released meanwhile.
+func issueCreator(name string, w http.ResponseWriter) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return
+	}
+	token := hex.EncodeToString(b)
+	sum := sha256.Sum256([]byte(token))
+
+	if err := mutate(raftEntry{
+		Op:      "creator",
+		Room:    name,
+		Time:    time.Now().UTC(),
+		Creator: sum[:],
+	}); err != nil {
+		return
+	}
+
+	setCreator(name, token, w)
+}
+
+// isCreator reports whether r carries the creator token of the room.
+func isCreator(name string, r *http.Request) bool {
+	rm, ok := rooms[name]
+	if !ok || rm.creator == nil {
+		return false
+	}
+
+	c, err := r.Cookie(creatorCookie)
+	if err != nil {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(c.Value))
+	return subtle.ConstantTimeCompare(sum[:], rm.creator) == 1
+}
+
+// rename moves the room and its history to a new name, leaving a redirect
+// behind. Only the creator may rename a room, and only while no msgs are
+// scheduled for it.
+func rename(name string, w http.ResponseWriter, r *http.Request) {
+	waitRooms(name)
+
+	if !isCreator(name, r) {
+		http.Error(w, "not room creator", http.StatusForbidden)
+		return
+	}
+
+	to := strings.ToLower(r.PostFormValue("to"))
+
+	switch {
+	case to == "" || !validName.MatchString(to):
+		http.Error(w, "bad name", http.StatusBadRequest)
+		return
+	case len(to) > maxNameLen:
+		http.Error(w, "name too long", http.StatusBadRequest)
+		return
+	case reserved[to]:
+		http.Error(w, errReserved.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Scheduled msgs are posted by name, so they would recreate the old
+	// room.
+	if rooms[name].scheduled != 0 {
+		http.Error(w, "room has scheduled msgs", http.StatusConflict)
+		return
+	}
+
+	if _, ok := rooms[to]; ok {
+		http.Error(w, errRoomExists.Error(), http.StatusConflict)
+		return
+	}
+	if _, ok := resolve(to); ok {
+		http.Error(w, errRoomExists.Error(), http.StatusConflict)
+		return
+	}
+
+	err := mutate(raftEntry{
+		Op:   "rename",
+		Room: name,
+		To:   to,
+		Time: time.Now().UTC(),
+	})
+	switch err {
+	case nil:
+	case errNotLeader:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	c, _ := r.Cookie(creatorCookie)
+	setCreator(to, c.Value, w)
+	http.SetCookie(w, &http.Cookie{
+		Name:   creatorCookie,
+		Path:   prefix + "/" + name,
+		MaxAge: -1,
+	})
+
+	http.Redirect(w, r, prefix+"/"+to, http.StatusSeeOther)
+}
+
+// renameRoom moves the room to the name to as of now, leaving a redirect
+// behind. The global lock must be held for writing.
+func renameRoom(name, to string, now time.Time) error {
+	waitRooms(name)
+
+	rm, ok := rooms[name]
+	if !ok {
+		return errNoSuchRoom
+	}
+	if _, ok := rooms[to]; ok {
+		return errRoomExists
+	}
+
+	delete(rooms, name)
+	rooms[to] = rm
+
+	pruneStore([]string{name})
+	saveRoom(to)
+
+	redirects[name] = redirect{
+		to:      to,
+		expires: now.Add(lifespan),
+	}
+
+	// Sessions following the old name pick up the redirect.
+	emit(roomsChanged{rooms: []string{name}})
+
+	return nil
+}
+
+// printRenameForm shows the rename form to the room creator.
+func printRenameForm(name string, w io.Writer, r *http.Request) {
+	if isCreator(name, r) {
+		fmt.Fprintf(w, renameForm, prefix, name, maxNameLen,
+			foldName.String())
+	}
+}
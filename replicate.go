@@ -0,0 +1,259 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	followInterval = 2 * time.Second
+
+	// maxImportBody bounds snapshots posted to /admin/import.
+	maxImportBody = 8 << 20
+
+	// followFailures is how many polls in a row may fail before a standby
+	// takes over as primary.
+	followFailures = 3
+)
+
+var (
+	// followURL is the primary a standby replicates from, e.g.
+	// https://a.example.com. Empty on the primary.
+	followURL string
+
+	// following is set while this instance is a read-only standby.
+	following bool
+
+	errStandby = errors.New("standby instance is read-only")
+)
+
+// roomState is the replicated form of a room.
+type roomState struct {
+	Msgs    []msgState `json:"msgs"`
+	Last    time.Time  `json:"last"`
+	Seq     uint64     `json:"seq"`
+	Creator []byte     `json:"creator,omitempty"`
+}
+
+type msgState struct {
+	S   string    `json:"s"`
+	At  time.Time `json:"at"`
+	Seq uint64    `json:"seq"`
+}
+
+// snapshot copies the state of every room. The global lock must be held.
+func snapshot() map[string]roomState {
+	state := make(map[string]roomState, len(rooms))
+
+	for name, rm := range rooms {
+		state[name] = stateOf(rm)
+	}
+
+	return state
+}
+
+func stateOf(rm *room) roomState {
+	rs := roomState{
+		Msgs:    make([]msgState, rm.msgs.Len()),
+		Last:    rm.last,
+		Seq:     rm.seq,
+		Creator: rm.creator,
+	}
+	for i := range rs.Msgs {
+		m := rm.msgs.At(i)
+		rs.Msgs[i] = msgState{S: m.s, At: m.at, Seq: m.seq}
+	}
+	return rs
+}
+
+// restore replaces every room with state, waking clients of rooms that
+// changed or are gone. The global lock must be held for writing.
+func restore(state map[string]roomState) {
+	all := make([]string, 0, len(rooms))
+	for name := range rooms {
+		all = append(all, name)
+	}
+	waitRooms(all...)
+
+	var gone []string
+	for name := range rooms {
+		if _, ok := state[name]; !ok {
+			delete(rooms, name)
+			gone = append(gone, name)
+		}
+	}
+	pruneStore(gone)
+	emit(roomsChanged{rooms: gone})
+
+	restoreRooms(state)
+}
+
+// restoreRooms replaces the rooms named in state, leaving others alone, once
+// posts to them finish. The global lock must be held for writing.
+func restoreRooms(state map[string]roomState) {
+	names := make([]string, 0, len(state))
+	for name := range state {
+		names = append(names, name)
+	}
+	waitRooms(names...)
+
+	var changed []string
+	for name, rs := range state {
+		rm, ok := rooms[name]
+		if !ok {
+			rm = newRoom(rs.Last)
+			rooms[name] = rm
+		} else if rm.seq == rs.Seq {
+			continue
+		}
+
+		msgs := make([]msg, len(rs.Msgs))
+		for i, m := range rs.Msgs {
+			msgs[i] = msg{
+				s:   m.S,
+				t:   m.At.Format("2006-01-02 15:04"),
+				at:  m.At,
+				seq: m.Seq,
+			}
+		}
+		rm.msgs = ringOf(msgs)
+		rm.last, rm.seq, rm.creator = rs.Last, rs.Seq, rs.Creator
+
+		saveRoom(name)
+		changed = append(changed, name)
+	}
+	emit(roomsChanged{rooms: changed})
+}
+
+// adminState serves the snapshot standbys replicate from.
+func adminState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snapshot()); err != nil {
+		log.Printf("state: %v", err)
+	}
+}
+
+// adminImport replaces rooms with those in the JSON snapshot in the body, as
+// written by adminState.
+func adminImport(w http.ResponseWriter, r *http.Request) {
+	var state map[string]roomState
+	if err := json.NewDecoder(io.LimitReader(r.Body,
+		maxImportBody)).Decode(&state); err != nil {
+		http.Error(w, "body invalid", http.StatusBadRequest)
+		return
+	}
+
+	for name, rs := range state {
+		if len(name) > maxNameLen || !validName.MatchString(name) ||
+			reserved[name] {
+			http.Error(w, "bad name: "+name, http.StatusBadRequest)
+			return
+		} else if len(rs.Msgs) > maxMsgsCount {
+			http.Error(w, "too many msgs: "+name,
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := mutate(raftEntry{
+		Op:    "import",
+		Time:  time.Now().UTC(),
+		State: state,
+	})
+	switch err {
+	case nil:
+	case errTooManyRooms:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), postStatus(err))
+		return
+	}
+
+	fmt.Fprintf(w, "imported %d rooms\n", len(state))
+}
+
+// importRooms replaces the rooms named in state, unless there would be too
+// many rooms. The global lock must be held for writing.
+func importRooms(state map[string]roomState) error {
+	added := 0
+	for name := range state {
+		if _, ok := rooms[name]; !ok {
+			added++
+		}
+	}
+
+	if len(rooms)+added > maxRoomCount {
+		return errTooManyRooms
+	}
+
+	restoreRooms(state)
+	return nil
+}
+
+func fetchState() (map[string]roomState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		followInterval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		strings.TrimSuffix(followURL, "/")+"/admin/state", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+
+	var state map[string]roomState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// follow replicates the primary until it stops answering, then takes over.
+func follow() {
+	failures := 0
+
+	for {
+		state, err := fetchState()
+		if err != nil {
+			failures++
+			log.Printf("follow: %v", err)
+		} else {
+			failures = 0
+		}
+
+		lock.Lock()
+		if err == nil {
+			restore(state)
+		} else if failures >= followFailures {
+			following = false
+		}
+		lock.Unlock()
+
+		if failures >= followFailures {
+			log.Println("follow: primary unreachable, taking over")
+			return
+		}
+
+		time.Sleep(followInterval)
+	}
+}
@@ -0,0 +1,108 @@
+package chat
+
+import "sync"
+
+// msgRing holds the newest maxMsgsCount msgs of a room in a buffer that,
+// once full, is written over from the oldest, so posting neither copies nor
+// allocates. Copies of a msgRing share the buffer, so only the ring of the
+// room itself is pushed to.
+type msgRing struct {
+	buf []msg
+
+	// next is one past the newest msg in buf.
+	next int
+
+	// gen counts changes, so a cached rendering can be told from stale.
+	gen   uint64
+	cache *htmlCache
+}
+
+// htmlCache holds the msgs of a ring as rendered for the room page, shared
+// by copies of the ring. Pages are rendered with the global lock held only
+// for reading, so it has its own.
+type htmlCache struct {
+	mu   sync.Mutex
+	gen  uint64
+	html string
+}
+
+// ringOf returns a msgRing holding msgs, newest first.
+func ringOf(msgs []msg) msgRing {
+	if len(msgs) > maxMsgsCount {
+		msgs = msgs[:maxMsgsCount]
+	}
+
+	r := msgRing{
+		buf:   make([]msg, len(msgs)),
+		next:  len(msgs),
+		gen:   1,
+		cache: new(htmlCache),
+	}
+	for i, m := range msgs {
+		r.buf[len(msgs)-1-i] = m
+	}
+	return r
+}
+
+// Len returns the number of msgs held.
+func (r msgRing) Len() int {
+	return len(r.buf)
+}
+
+// At returns the i-th newest msg, from 0.
+func (r msgRing) At(i int) msg {
+	j := r.next - 1 - i
+	if j < 0 {
+		j += len(r.buf)
+	}
+	return r.buf[j]
+}
+
+// push adds m as the newest msg, dropping the oldest if full.
+func (r *msgRing) push(m msg) {
+	if r.cache == nil {
+		r.cache = new(htmlCache)
+	}
+	r.gen++
+
+	if len(r.buf) < maxMsgsCount {
+		r.buf = append(r.buf, m)
+		r.next = len(r.buf)
+		return
+	}
+
+	r.next %= len(r.buf)
+	r.buf[r.next] = m
+	r.next++
+}
+
+// slice returns a copy of the msgs, newest first.
+func (r msgRing) slice() []msg {
+	msgs := make([]msg, r.Len())
+	for i := range msgs {
+		msgs[i] = r.At(i)
+	}
+	return msgs
+}
+
+// html returns the msgs rendered by printMsg, newest first. They are only
+// rendered again once changed.
+func (r msgRing) html() string {
+	if r.cache == nil {
+		return ""
+	}
+
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+
+	if r.cache.gen != r.gen {
+		b := getBuf()
+		for i := 0; i < r.Len(); i++ {
+			printMsg(b, r.At(i))
+		}
+		r.cache.gen, r.cache.html = r.gen, b.String()
+		putBuf(b)
+	}
+
+	return r.cache.html
+}
@@ -0,0 +1,220 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Tries is how many times an upload is attempted before it is given up.
+const s3Tries = 3
+
+// s3Bucket is an S3-compatible bucket archived rooms are uploaded to,
+// addressed path-style (endpoint/bucket/key) as MinIO and most other
+// implementations accept.
+type s3Bucket struct {
+	endpoint *url.URL
+	bucket   string
+	region   string
+	keyID    string
+	secret   string
+}
+
+// archiveS3, if set, is where archived rooms are uploaded, as
+// name/archiveTime.json like in archiveDir, and deleted from when purged.
+var archiveS3 *s3Bucket
+
+func newS3Bucket(endpoint, bucket, region, keyID, secret string) (*s3Bucket,
+	error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("s3: bad endpoint %q", endpoint)
+	}
+
+	return &s3Bucket{
+		endpoint: u,
+		bucket:   bucket,
+		region:   region,
+		keyID:    keyID,
+		secret:   secret,
+	}, nil
+}
+
+// upload puts b at key in the background, retrying with backoff, as rooms
+// are archived with the global lock held.
+func (s *s3Bucket) upload(key string, b []byte) {
+	go func() {
+		delay := time.Second
+		for i := 1; ; i++ {
+			err := s.put(key, b)
+			if err == nil {
+				return
+			} else if i == s3Tries {
+				log.Printf("s3: giving up on %s: %v", key, err)
+				return
+			}
+			time.Sleep(delay)
+			delay *= 4
+		}
+	}()
+}
+
+func (s *s3Bucket) put(key string, b []byte) error {
+	resp, err := s.do("PUT", key, nil, b)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// remove deletes every object under prefix in the background, as rooms are
+// purged with the global lock held.
+func (s *s3Bucket) remove(prefix string) {
+	go func() {
+		if err := s.deleteAll(prefix); err != nil {
+			log.Printf("s3: deleting %s: %v", prefix, err)
+		}
+	}()
+}
+
+// s3List is a page of ListObjectsV2.
+type s3List struct {
+	Keys      []string `xml:"Contents>Key"`
+	Truncated bool     `xml:"IsTruncated"`
+	Next      string   `xml:"NextContinuationToken"`
+}
+
+// deleteAll lists the objects under prefix and deletes them one by one.
+func (s *s3Bucket) deleteAll(prefix string) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+
+	for {
+		resp, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return err
+		}
+		var list s3List
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("list: status %s", resp.Status)
+		} else if err != nil {
+			return err
+		}
+
+		for _, key := range list.Keys {
+			resp, err := s.do("DELETE", key, nil, nil)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusNoContent &&
+				resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s: status %s", key, resp.Status)
+			}
+		}
+
+		if !list.Truncated {
+			return nil
+		}
+		query.Set("continuation-token", list.Next)
+	}
+}
+
+// do sends a signed request for the object at key, or for the bucket itself
+// if key is empty.
+func (s *s3Bucket) do(method, key string, query url.Values,
+	b []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	// Spaces are %20 in the canonical query string, not +.
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(b)
+	payload := hex.EncodeToString(sum[:])
+	now := time.Now().UTC()
+
+	headers := map[string]string{
+		"x-amz-content-sha256": payload,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	if b != nil {
+		headers["content-type"] = "application/json"
+	}
+	for name, v := range headers {
+		req.Header.Set(name, v)
+	}
+	req.Header.Set("Authorization", s.sign(method, u.EscapedPath(),
+		u.RawQuery, u.Host, headers, payload, now))
+
+	return http.DefaultClient.Do(req)
+}
+
+// sign returns the AWS Signature Version 4 Authorization header for a
+// request with the already sorted and escaped query, signing host and
+// headers, whose names must be lowercase.
+func (s *s3Bucket) sign(method, path, query, host string,
+	headers map[string]string, payload string, t time.Time) string {
+	headers["host"] = host
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canon strings.Builder
+	fmt.Fprintf(&canon, "%s\n%s\n%s\n", method, path, query)
+	for _, name := range names {
+		fmt.Fprintf(&canon, "%s:%s\n", name,
+			strings.TrimSpace(headers[name]))
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canon, "\n%s\n%s", signed, payload)
+
+	date := t.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canon.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" +
+		scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + s.secret)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	return "AWS4-HMAC-SHA256 Credential=" + s.keyID + "/" + scope +
+		", SignedHeaders=" + signed + ", Signature=" +
+		hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
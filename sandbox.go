@@ -0,0 +1,49 @@
+//go:build !freebsd
+
+package chat
+
+import (
+	"crypto/x509"
+	"net"
+
+	"github.com/esote/openshim2"
+)
+
+// sandbox restricts the process once its listeners are open. On OpenBSD
+// this is pledge(2); openshim2 makes it a no-op on other systems.
+func sandbox(lns ...net.Listener) error {
+	if err := openshim2.LazySysctls(); err != nil {
+		return err
+	}
+
+	promises := "stdio inet"
+	if outbound {
+		promises += " dns"
+
+		// The roots are read on the first TLS handshake otherwise,
+		// which rpath would be needed for.
+		if _, err := x509.SystemCertPool(); err != nil {
+			return err
+		}
+	}
+	if rereads {
+		promises += " rpath"
+	}
+	if writes {
+		promises += " wpath cpath"
+	}
+	if flocks {
+		promises += " flock"
+	}
+	if upgrades {
+		promises += " proc exec"
+	}
+	for _, ln := range lns {
+		if ln.Addr().Network() == "unix" {
+			promises += " unix"
+			break
+		}
+	}
+
+	return openshim2.Pledge(promises, "")
+}
@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandbox limits each pre-opened listener to the rights needed to accept and
+// serve connections, then enters Capsicum capability mode. Accepted sockets
+// inherit the rights of their listener, and no new descriptors can be
+// opened by path or address afterwards, so features needing to are refused
+// rather than left unconfined; -no-sandbox runs them without.
+func sandbox(lns ...net.Listener) error {
+	switch {
+	case outbound:
+		// Capability mode forbids creating sockets.
+		return capConflict("connecting out")
+	case rereads:
+		return capConflict("rereading files")
+	case writes:
+		return capConflict("writing files")
+	case upgrades:
+		return capConflict("starting the binary anew on upgrade")
+	case datagrams:
+		// A UDP socket cannot send to the addresses of its peers.
+		return capConflict("serving UDP")
+	}
+
+	rights, err := unix.CapRightsInit([]uint64{
+		unix.CAP_ACCEPT,
+		unix.CAP_EVENT,
+		unix.CAP_FCNTL,
+		unix.CAP_FSTAT,
+		unix.CAP_GETPEERNAME,
+		unix.CAP_GETSOCKNAME,
+		unix.CAP_GETSOCKOPT,
+		unix.CAP_READ,
+		unix.CAP_SETSOCKOPT,
+		unix.CAP_SHUTDOWN,
+		unix.CAP_WRITE,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, ln := range lns {
+		sc, ok := ln.(syscall.Conn)
+		if !ok {
+			return errors.New("sandbox: listener has no descriptor")
+		}
+
+		raw, err := sc.SyscallConn()
+		if err != nil {
+			return err
+		}
+
+		var lerr error
+		if err = raw.Control(func(fd uintptr) {
+			lerr = unix.CapRightsLimit(fd, rights)
+		}); err != nil {
+			return err
+		}
+		if lerr != nil {
+			return lerr
+		}
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_CAP_ENTER, 0, 0, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// capConflict is the error of a feature configured needing what capability
+// mode forbids after startup.
+func capConflict(what string) error {
+	return fmt.Errorf("sandbox: capability mode forbids %s, as "+
+		"configured; use -no-sandbox to run unconfined", what)
+}
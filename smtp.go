@@ -0,0 +1,276 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	// maxMailSize bounds the DATA of one mail.
+	maxMailSize = 64 << 10
+
+	// maxRcpts bounds the rooms one mail is posted to.
+	maxRcpts = 5
+)
+
+// smtpDomain, if set, is the only domain accepted in recipients.
+var smtpDomain string
+
+// smtpConn serves an SMTP session over c, posting the first line of each
+// mail's body to the rooms named by its recipients' local parts.
+func smtpConn(c net.Conn) {
+	defer c.Close()
+
+	host := remoteHost(c)
+	tp := textproto.NewConn(c)
+
+	deadline := func() bool {
+		return c.SetDeadline(time.Now().Add(5*time.Minute)) == nil
+	}
+
+	if !deadline() || tp.PrintfLine("220 chat ESMTP") != nil {
+		return
+	}
+
+	var rcpts []string
+	from := false
+
+	for deadline() {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+
+		var reply string
+		switch verb {
+		case "HELO":
+			reply = "250 chat"
+		case "EHLO":
+			reply = fmt.Sprintf("250-chat\r\n250 SIZE %d", maxMailSize)
+		case "MAIL":
+			from, rcpts = true, nil
+			reply = "250 ok"
+		case "RCPT":
+			reply = smtpRcpt(arg, from, &rcpts)
+		case "DATA":
+			if len(rcpts) == 0 {
+				reply = "503 need RCPT first"
+				break
+			}
+			if tp.PrintfLine("354 end with .") != nil {
+				return
+			}
+			reply = smtpData(tp.DotReader(), rcpts, host)
+			from, rcpts = false, nil
+		case "RSET":
+			from, rcpts = false, nil
+			reply = "250 ok"
+		case "NOOP":
+			reply = "250 ok"
+		case "VRFY":
+			reply = "252 cannot verify"
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			reply = "502 command not implemented"
+		}
+
+		if tp.PrintfLine("%s", reply) != nil {
+			return
+		}
+	}
+}
+
+func smtpRcpt(arg string, from bool, rcpts *[]string) string {
+	if !from {
+		return "503 need MAIL first"
+	}
+	if len(*rcpts) >= maxRcpts {
+		return "452 too many recipients"
+	}
+
+	upper := strings.ToUpper(arg)
+	if !strings.HasPrefix(upper, "TO:") {
+		return "501 syntax: RCPT TO:<room@host>"
+	}
+
+	addr, err := mail.ParseAddress(strings.TrimSpace(arg[3:]))
+	if err != nil {
+		return "501 bad address"
+	}
+
+	local, domain, _ := strings.Cut(addr.Address, "@")
+	name := strings.ToLower(local)
+	if name == "" || len(name) > maxNameLen || !validName.MatchString(name) ||
+		smtpDomain != "" && !strings.EqualFold(domain, smtpDomain) {
+		return "550 no such room"
+	}
+
+	*rcpts = append(*rcpts, name)
+	return "250 ok"
+}
+
+// smtpData reads a mail and posts it, returning the reply. Every recipient is
+// checked before any is posted to, so a mail is refused whole rather than
+// posted to some rooms and then sent again to all by a retry. Posts failing
+// anyway once others went through are listed in the 250 reply.
+func smtpData(r io.Reader, rcpts []string, host string) string {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxMailSize+1))
+	if err != nil {
+		return "451 read failed"
+	}
+	if len(b) > maxMailSize {
+		_, _ = io.Copy(ioutil.Discard, r)
+		return "552 message too large"
+	}
+
+	str, err := mailText(b)
+	if err != nil {
+		return "554 " + err.Error()
+	}
+	if _, err := cleanMsg(str); err != nil {
+		return "554 " + err.Error()
+	}
+
+	names, err := smtpRooms(rcpts, host)
+	if err != nil {
+		return "554 " + err.Error()
+	}
+
+	var failed []string
+	for _, name := range names {
+		_, err := addMsg(name, str, clientID(host))
+		if err != nil && err != errHeld {
+			failed = append(failed, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	switch {
+	case len(failed) == len(names):
+		return "554 " + strings.Join(failed, "; ")
+	case len(failed) != 0:
+		return "250 posted, except to " + strings.Join(failed, "; ")
+	}
+	return "250 posted"
+}
+
+// smtpRooms resolves the recipients to the rooms to post to, once each,
+// checking each may be posted to by the client at host.
+func smtpRooms(rcpts []string, host string) ([]string, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	var names []string
+	seen := make(map[string]bool)
+	creating := 0
+
+	for _, name := range rcpts {
+		name, _ = resolve(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		_, exists := rooms[name]
+		if !exists {
+			creating++
+		}
+
+		var err error
+		switch {
+		case reserved[name]:
+			err = errReserved
+		case geoBlocked(host, !exists):
+			err = errGeoBlocked
+		case !exists && len(rooms)+creating > maxRoomCount:
+			err = errTooManyRooms
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// mailText returns the first non-empty line of the plain text of a mail.
+func mailText(b []byte) (string, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return "", errBadMsg
+	}
+
+	body, err := plainPart(m.Header.Get("Content-Type"),
+		m.Header.Get("Content-Transfer-Encoding"), m.Body, 0)
+	if err != nil {
+		return "", err
+	}
+
+	sc := bufio.NewScanner(body)
+	sc.Buffer(make([]byte, 0, 1024), maxMailSize)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			return line, nil
+		}
+	}
+
+	return "", errBadMsg
+}
+
+// plainPart finds the text/plain body of a possibly multipart mail.
+func plainPart(ctype, cte string, r io.Reader, depth int) (io.Reader,
+	error) {
+	if ctype == "" {
+		ctype = "text/plain"
+	}
+
+	mt, params, err := mime.ParseMediaType(ctype)
+	if err != nil || depth > 3 {
+		return nil, errBadMsg
+	}
+
+	switch strings.ToLower(cte) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+
+	switch {
+	case mt == "text/plain":
+		return r, nil
+	case strings.HasPrefix(mt, "multipart/"):
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				return nil, errBadMsg
+			}
+			if body, err := plainPart(p.Header.Get("Content-Type"),
+				p.Header.Get("Content-Transfer-Encoding"), p,
+				depth+1); err == nil {
+				return body, nil
+			}
+		}
+	}
+
+	return nil, errBadMsg
+}
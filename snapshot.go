@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// loadSnapshot restores the rooms saved in the file at path by
+// saveSnapshot, if it exists.
+func loadSnapshot(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var state map[string]roomState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+
+	lock.Lock()
+	restoreRooms(state)
+	lock.Unlock()
+
+	return nil
+}
+
+// saveSnapshot writes the rooms to the file at path, in the format of
+// /admin/state.
+func saveSnapshot(path string) error {
+	lock.Lock()
+	b, err := json.Marshal(snapshot())
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, b)
+}
+
+// writeFile replaces the file at path with b whole, so a crash midway leaves
+// the previous contents.
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// autosave saves a snapshot to path every interval, forever, so a crash
+// loses at most an interval of msgs.
+func autosave(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := saveSnapshot(path); err != nil {
+			log.Printf("snapshot: %v", err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// sshConfig builds the SSH server configuration from the host key at keyFile.
+// If authFile is empty anyone may connect; otherwise clients must present a
+// key listed in authFile, in authorized_keys format.
+func sshConfig(keyFile, authFile string) (*ssh.ServerConfig, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{
+		NoClientAuth:  authFile == "",
+		ServerVersion: "SSH-2.0-chat",
+	}
+	config.AddHostKey(key)
+
+	if authFile == "" {
+		return config, nil
+	}
+
+	b, err = ioutil.ReadFile(authFile)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool)
+
+	for len(bytes.TrimSpace(b)) > 0 {
+		pub, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, err
+		}
+		allowed[string(pub.Marshal())] = true
+		b = rest
+	}
+
+	config.PublicKeyCallback = func(_ ssh.ConnMetadata,
+		pub ssh.PublicKey) (*ssh.Permissions, error) {
+		if allowed[string(pub.Marshal())] {
+			return nil, nil
+		}
+		return nil, errors.New("unknown key")
+	}
+
+	return config, nil
+}
+
+// sshConn serves an SSH connection. Each session channel gets a menu of rooms
+// and then a line-mode chat in the room picked.
+func sshConn(c net.Conn, config *ssh.ServerConfig) {
+	defer c.Close()
+
+	if err := c.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return
+	}
+
+	sc, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	defer sc.Close()
+
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "unsupported channel")
+			continue
+		}
+
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		go sshSession(ch, reqs, remoteHost(c))
+	}
+}
+
+func sshSession(ch ssh.Channel, reqs <-chan *ssh.Request, host string) {
+	defer ch.Close()
+
+	t := term.NewTerminal(ch, "room: ")
+
+	go func() {
+		for req := range reqs {
+			ok := false
+
+			switch req.Type {
+			case "pty-req":
+				// string term, uint32 cols, uint32 rows, ...
+				if len(req.Payload) < 4 {
+					break
+				}
+				n := binary.BigEndian.Uint32(req.Payload)
+				ok = sshResize(t, req.Payload[4:], int(n))
+			case "window-change":
+				ok = sshResize(t, req.Payload, 0)
+			case "shell":
+				ok = true
+			}
+
+			if req.WantReply {
+				_ = req.Reply(ok, nil)
+			}
+		}
+	}()
+
+	var names []string
+
+	lock.Lock()
+	pruneRooms()
+	for name := range rooms {
+		names = append(names, name)
+	}
+	lock.Unlock()
+
+	sort.Strings(names)
+
+	fmt.Fprintln(t, "Room-based chat server")
+	fmt.Fprintf(t, "room lifespan: %s\n\n", lifespan)
+	for _, name := range names {
+		fmt.Fprintf(t, "  %s\n", name)
+	}
+	fmt.Fprintln(t, "\npick a room above or name a new one")
+
+	name, err := t.ReadLine()
+	if err != nil {
+		return
+	}
+
+	t.SetPrompt("> ")
+
+	lineChat(name, host, t.ReadLine, func(s string) error {
+		_, err := fmt.Fprintln(t, s)
+		return err
+	})
+}
+
+// sshResize applies the "cols, rows" pair at the start of b, after skipping
+// n bytes, to t.
+func sshResize(t *term.Terminal, b []byte, n int) bool {
+	if len(b) < n+8 {
+		return false
+	}
+
+	b = b[n:]
+	cols := binary.BigEndian.Uint32(b)
+	rows := binary.BigEndian.Uint32(b[4:])
+
+	return t.SetSize(int(cols), int(rows)) == nil
+}
@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"crypto/sha512"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// staticFiles are the assets served under /static/.
+//
+//go:embed static
+var staticFiles embed.FS
+
+var (
+	staticFS, staticHashes = loadStatic()
+
+	staticServer = http.FileServer(http.FS(staticFS))
+)
+
+// loadStatic returns the assets and the SHA-512 of each, by name.
+func loadStatic() (fs.FS, map[string][]byte) {
+	sub, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	hashes := make(map[string][]byte)
+	err = fs.WalkDir(sub, ".", func(name string, d fs.DirEntry,
+		err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(sub, name)
+		if err != nil {
+			return err
+		}
+		sum := sha512.Sum512(b)
+		hashes[name] = sum[:]
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return sub, hashes
+}
+
+// integrity returns the Subresource Integrity hash of the asset, for pages
+// loading it.
+func integrity(name string) string {
+	return "sha512-" + base64.StdEncoding.EncodeToString(staticHashes[name])
+}
+
+// static serves the assets, revalidated by their hash after an hour.
+func static(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	if r.URL.Path == "/realtime.js" {
+		name = "realtime.js"
+	}
+
+	sum, ok := staticHashes[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	securityHeaders(w)
+	setCSP(w, "default-src 'none';")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum[:16]))
+
+	// The file server wants the name alone.
+	u := *r.URL
+	u.Path = "/" + name
+	r2 := *r
+	r2.URL = &u
+	staticServer.ServeHTTP(w, &r2)
+}
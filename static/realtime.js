@@ -0,0 +1,128 @@
+"use strict";
+const http = new XMLHttpRequest();
+const chat = document.getElementById("chat");
+const banner = document.getElementById("status");
+const path = window.location.pathname.split("/").pop();
+
+// Poll slowly while the tab is hidden, and catch up as soon as it is shown.
+// The server may ask for a longer interval with X-Poll-Interval.
+let visibleInterval = 1000;
+const hiddenInterval = 30000;
+
+// Back off exponentially while the server is unreachable.
+const maxBackoff = 60000;
+
+let timer = null;
+let busy = false;
+let failures = 0;
+
+// seq is the latest msg shown, from X-Seq, so polls fetch only newer msgs
+// and, while visible, wait on the server for them.
+let seq = -1;
+const maxMsgs = 50;
+
+// Updates are pushed over a WebSocket while it is open, and polled for
+// otherwise.
+let live = false;
+
+function schedule(delay) {
+	clearTimeout(timer);
+	if (!live) {
+		timer = setTimeout(update, delay);
+	}
+}
+
+function connect() {
+	const scheme = window.location.protocol == "https:" ? "wss://" : "ws://";
+	const dir = window.location.pathname.replace(/[^/]*$/, "");
+	const ws = new WebSocket(scheme + window.location.host + dir + "ws/" +
+		path);
+
+	ws.onopen = function() {
+		live = true;
+		clearTimeout(timer);
+		banner.hidden = true;
+	};
+	ws.onmessage = function(e) {
+		if (e.data != chat.innerHTML) {
+			chat.innerHTML = e.data;
+		}
+	};
+	ws.onclose = function() {
+		live = false;
+		// Frames carry no seq, so the chat shown may be newer than
+		// seq: reload it in full before polling for deltas again.
+		seq = -1;
+		schedule(visibleInterval);
+	};
+}
+
+http.onreadystatechange = function() {
+	if (http.readyState != 4) {
+		return;
+	}
+	busy = false;
+
+	if (http.status == 200) {
+		const hint = parseInt(http.getResponseHeader("X-Poll-Interval"),
+			10);
+		if (hint > 0) {
+			visibleInterval = hint;
+		}
+
+		failures = 0;
+		banner.hidden = true;
+		const pre = chat.querySelector("pre");
+		if (http.getResponseHeader("X-Delta") == "1" && pre != null) {
+			pre.insertAdjacentHTML("afterbegin", http.responseText);
+			while (pre.children.length > maxMsgs) {
+				pre.lastElementChild.remove();
+			}
+		} else if (http.responseText != ""
+			&& http.responseText != chat.innerHTML) {
+			chat.innerHTML = http.responseText;
+		}
+		seq = parseInt(http.getResponseHeader("X-Seq"), 10);
+		schedule(document.hidden
+			? Math.max(hiddenInterval, visibleInterval)
+			: visibleInterval);
+		return;
+	}
+
+	failures++;
+	let delay = Math.min(1000 * 2 ** failures, maxBackoff);
+	const retry = parseInt(http.getResponseHeader("Retry-After"), 10);
+	if (retry > 0) {
+		delay = Math.max(delay, retry * 1000);
+	}
+
+	banner.textContent = "offline, reconnecting in "
+		+ Math.round(delay / 1000) + "s";
+	banner.hidden = false;
+	schedule(delay);
+}
+
+function update() {
+	clearTimeout(timer);
+	busy = true;
+	let url = path;
+	if (seq >= 0) {
+		url += "?since=" + seq + (document.hidden ? "" : "&wait=30s");
+	}
+	http.open("PATCH", url, true);
+	http.send(null);
+}
+
+function resume() {
+	if (!live && !busy && !document.hidden) {
+		update();
+	}
+}
+
+document.addEventListener("visibilitychange", resume);
+window.addEventListener("online", resume);
+
+if ("WebSocket" in window) {
+	connect();
+}
+schedule(visibleInterval);
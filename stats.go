@@ -0,0 +1,292 @@
+package chat
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idKey keys client IDs. It lives only in memory, so IDs cannot be linked
+// across restarts or back to addresses.
+var idKey = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// clientID returns a short opaque ID for the host in addr.
+func clientID(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	mac := hmac.New(sha256.New, idKey)
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// roomStats holds in-memory counters for a room, which are dropped along
+// with the room when it is pruned.
+type roomStats struct {
+	total   int
+	hours   map[int64]int        // msgs per Unix hour, last 24 hours only
+	posters map[string]time.Time // first msg of each poster
+}
+
+func newRoomStats() *roomStats {
+	return &roomStats{
+		hours:   make(map[int64]int),
+		posters: make(map[string]time.Time),
+	}
+}
+
+func (st *roomStats) count(t time.Time, id string) {
+	hour := t.Unix() / 3600
+
+	st.total++
+	st.hours[hour]++
+	if _, ok := st.posters[id]; !ok {
+		st.posters[id] = t
+	}
+
+	for h := range st.hours {
+		if h <= hour-24 {
+			delete(st.hours, h)
+		}
+	}
+}
+
+// merge adds the counts of other into st.
+func (st *roomStats) merge(other *roomStats) {
+	st.total += other.total
+
+	for h, n := range other.hours {
+		st.hours[h] += n
+	}
+
+	for id, t := range other.posters {
+		if first, ok := st.posters[id]; !ok || t.Before(first) {
+			st.posters[id] = t
+		}
+	}
+}
+
+const roomStatsPageStart = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport"
+		content="width=device-width, initial-scale=1, shrink-to-fit=no">
+	<title>Stats: %s</title>
+</head>
+<body>
+	<p>stats: %s</p>
+	<p><a href="%s/%s">&lt; back</a></p>
+	<p>msgs: %d, unique posters: %d</p>
+	<p>last 24 hours (UTC, oldest first):</p>
+	<pre>%s</pre>
+	<p>peak: %s</p>
+	<table>
+		<tr><th>hour</th><th>msgs</th></tr>`
+
+const roomStatsPageEnd = `
+	</table>
+</body>
+</html>`
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+func roomStatsPage(name string, w http.ResponseWriter, r *http.Request) {
+	rm, ok := rooms[name]
+	if !ok {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	st := rm.stats
+	now := time.Now().UTC().Unix() / 3600
+
+	var peak int64
+	max := 0
+	for h := now - 23; h <= now; h++ {
+		if st.hours[h] > max {
+			peak, max = h, st.hours[h]
+		}
+	}
+
+	spark := make([]rune, 0, 24)
+	for h := now - 23; h <= now; h++ {
+		if max == 0 {
+			spark = append(spark, sparks[0])
+			continue
+		}
+		spark = append(spark, sparks[st.hours[h]*(len(sparks)-1)/max])
+	}
+
+	peakStr := "none"
+	if max > 0 {
+		peakStr = fmt.Sprintf("%d msgs at %s", max,
+			time.Unix(peak*3600, 0).UTC().Format("2006-01-02 15:00"))
+	}
+
+	setCSP(w, "default-src 'none';")
+
+	fmt.Fprintf(w, roomStatsPageStart, name, name, prefix, name, st.total,
+		len(st.posters), string(spark), peakStr)
+
+	for h := now; h > now-24; h-- {
+		if st.hours[h] == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n\t\t<tr><td>%s</td><td>%d</td></tr>",
+			time.Unix(h*3600, 0).UTC().Format("2006-01-02 15:00"),
+			st.hours[h])
+	}
+
+	fmt.Fprint(w, roomStatsPageEnd)
+}
+
+// serverStats holds instance-wide counters. Rooms are posted to with the
+// global lock held only for reading, so it has its own.
+type serverStats struct {
+	sync.Mutex
+
+	started time.Time
+	day     string
+	today   int // msgs posted on day (UTC)
+	total   int
+}
+
+var server = serverStats{started: time.Now().UTC()}
+
+func (st *serverStats) count(t time.Time) {
+	st.Lock()
+	defer st.Unlock()
+
+	if day := t.Format("2006-01-02"); day != st.day {
+		st.day, st.today = day, 0
+	}
+
+	st.today++
+	st.total++
+}
+
+// frontend is a way of reaching the rooms other than HTTP.
+type frontend struct {
+	name, addr string
+}
+
+// frontends lists the frontends configured, in the order of their flags.
+func frontends() []frontend {
+	all := []frontend{
+		{"gopher", gopherAddr},
+		{"line-mode TCP (telnet, nc)", lineAddr},
+		{"IRC", ircAddr},
+		{"NNTP (read-only)", nntpAddr},
+		{"SMTP (mail to room@host)", smtpAddr},
+		{"Gemini", geminiAddr},
+		{"HTTP/3 (UDP)", http3Addr},
+		{"SSH", sshAddr},
+		{"gRPC", grpcAddr},
+	}
+
+	// The XMPP component connects out, so is reached by its domain.
+	if xmppAddr != "" {
+		all = append(all, frontend{"XMPP (rooms as MUCs)", xmppDomain})
+	}
+
+	var list []frontend
+	for _, f := range all {
+		if f.addr != "" {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+const aboutPageStart = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport"
+		content="width=device-width, initial-scale=1, shrink-to-fit=no">
+	<title>About: Room-based chat server</title>
+</head>
+<body>
+	<p>about this server</p>
+	<p><a href="%s/">&lt; back</a></p>
+	<p>uptime: %s</p>
+	<p>rooms: %d of %d, msgs today (UTC): %d, msgs since start: %d</p>
+	<p>limits:</p>
+	<ul>
+		<li>room lifespan: %s (time until lossy room pruning may occur)</li>
+		<li>room name: up to %d lowercase letters</li>
+		<li>msg length: %d</li>
+		<li>history per room: %d msgs</li>
+		<li>scheduled msgs per room: %d</li>
+	</ul>
+	<p>also reachable over:</p>
+	<ul>`
+
+const aboutPageEnd = `
+	</ul>
+</body>
+</html>`
+
+func about(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now().UTC()
+
+	// The global lock is held only for reading, so rooms due to be pruned
+	// are left to pruneLoop, and not counted.
+	live := 0
+	for _, rm := range rooms {
+		rm.mu.Lock()
+		if rm.scheduled != 0 || rm.posting || now.Sub(rm.last) <= lifespan {
+			live++
+		}
+		rm.mu.Unlock()
+	}
+
+	server.Lock()
+	today, total := server.today, server.total
+	if server.day != now.Format("2006-01-02") {
+		today = 0
+	}
+	server.Unlock()
+
+	setCSP(w, "default-src 'none';")
+
+	uptime := now.Sub(server.started).Round(time.Second)
+
+	fmt.Fprintf(w, aboutPageStart, prefix, uptime, live,
+		maxRoomCount, today, total, lifespan, maxNameLen, maxMsgLen,
+		maxMsgsCount, maxScheduled)
+
+	list := frontends()
+	for _, f := range list {
+		fmt.Fprintf(w, "\n\t\t<li>%s on %s</li>", f.name,
+			html.EscapeString(f.addr))
+	}
+	if len(list) == 0 {
+		fmt.Fprint(w, "\n\t\t<li>HTTP only</li>")
+	}
+
+	fmt.Fprint(w, aboutPageEnd)
+}
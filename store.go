@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Message is a msg as kept by a Store.
+type Message struct {
+	Seq  uint64
+	Time time.Time
+
+	// HTML is the escaped text of the msg, as shown in rooms.
+	HTML string
+}
+
+// Store keeps rooms beyond the life of the process. Rooms are served from
+// memory; the Store is told of each change as it is made, with the global
+// lock held, and read once at start to restore them. Rooms and msgs the
+// Store fails to add are not added.
+//
+// AppendMessage is the exception: it is called without the global lock, so
+// msgs to different rooms may be appended at once, but never two to the
+// same room.
+type Store interface {
+	// CreateRoom adds an empty room.
+	CreateRoom(name string) error
+
+	// AppendMessage adds m as the newest msg of the room.
+	AppendMessage(name string, m Message) error
+
+	// Messages returns the msgs of the room, newest first.
+	Messages(name string) ([]Message, error)
+
+	// Prune deletes the rooms and their msgs.
+	Prune(names []string) error
+
+	// ListRooms returns the names of the rooms.
+	ListRooms() ([]string, error)
+}
+
+// store is where rooms are kept, set before serving.
+var store Store = &memStore{rooms: make(map[string][]Message)}
+
+// memStore is the default Store, keeping rooms and their msgs in memory, so
+// they last only as long as the process. Like the others it keeps the
+// newest maxMsgsCount msgs of each room.
+type memStore struct {
+	mu    sync.Mutex
+	rooms map[string][]Message // newest first
+}
+
+func (s *memStore) CreateRoom(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[name]; !ok {
+		s.rooms[name] = []Message{}
+	}
+	return nil
+}
+
+func (s *memStore) AppendMessage(name string, m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := append([]Message{m}, s.rooms[name]...)
+	if len(msgs) > maxMsgsCount {
+		msgs = msgs[:maxMsgsCount]
+	}
+	s.rooms[name] = msgs
+	return nil
+}
+
+func (s *memStore) Messages(name string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Message(nil), s.rooms[name]...), nil
+}
+
+func (s *memStore) Prune(names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range names {
+		delete(s.rooms, name)
+	}
+	return nil
+}
+
+func (s *memStore) ListRooms() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.rooms))
+	for name := range s.rooms {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// loadRooms restores the rooms kept by store. The global lock must be held.
+func loadRooms() error {
+	names, err := store.ListRooms()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		msgs, err := store.Messages(name)
+		if err != nil {
+			return err
+		}
+
+		if len(msgs) > maxMsgsCount {
+			msgs = msgs[:maxMsgsCount]
+		}
+
+		loaded := make([]msg, len(msgs))
+		for i, m := range msgs {
+			loaded[i] = msg{
+				s:   m.HTML,
+				t:   m.Time.Format("2006-01-02 15:04"),
+				at:  m.Time,
+				seq: m.Seq,
+			}
+		}
+
+		rm := newRoom(time.Now().UTC())
+		rm.msgs = ringOf(loaded)
+		if len(msgs) != 0 {
+			rm.last, rm.seq = msgs[0].Time, msgs[0].Seq
+		}
+
+		rooms[name] = rm
+	}
+
+	return nil
+}
+
+// saveRoom replaces the room in store with the one in memory, after changes
+// that rewrite its history, like renames and merges. Failures are logged, as
+// the change is already made. The global lock must be held.
+func saveRoom(name string) {
+	if err := writeRoom(name); err != nil {
+		log.Printf("store: save %s: %v", name, err)
+	}
+}
+
+func writeRoom(name string) error {
+	if err := store.Prune([]string{name}); err != nil {
+		return err
+	}
+
+	if err := store.CreateRoom(name); err != nil {
+		return err
+	}
+
+	msgs := rooms[name].msgs
+	for i := msgs.Len() - 1; i >= 0; i-- {
+		m := msgs.At(i)
+		if err := store.AppendMessage(name, Message{
+			Seq:  m.seq,
+			Time: m.at,
+			HTML: m.s,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneStore deletes rooms pruned from memory from store, logging failures:
+// the rooms are gone either way.
+func pruneStore(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	if err := store.Prune(names); err != nil {
+		log.Printf("store: prune: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tail serves /name/tail, the plain text transcript of the room followed by
+// each new msg as it arrives, for curl -N. Called with the global lock held
+// for reading, which is released while waiting.
+func tail(name string, w http.ResponseWriter, r *http.Request) {
+	if _, ok := rooms[name]; !ok {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported",
+			http.StatusInternalServerError)
+		return
+	}
+
+	streams.Add(1)
+	defer streams.Done()
+
+	sub := watch(name)
+	defer sub.stop()
+
+	setCSP(w, "default-src 'none';")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-transform")
+
+	var seen uint64
+	stopping := false
+
+	for {
+		rm, ok := rooms[name]
+		if !ok {
+			to, moved := resolve(name)
+			if !moved {
+				fmt.Fprintln(w, "room expired")
+				return
+			}
+			name = to
+			sub.follow(to)
+			continue
+		}
+
+		var b strings.Builder
+		rm.mu.Lock()
+		for i := rm.msgs.Len() - 1; i >= 0; i-- {
+			if m := rm.msgs.At(i); m.seq > seen {
+				fmt.Fprintln(&b, m)
+			}
+		}
+		seen = rm.seq
+		rm.unlock()
+
+		// One last pass delivers msgs posted before shutdown, then the
+		// notice.
+		if stopping && noticeShutdown() {
+			fmt.Fprintln(&b, "notice: "+shutdownNotice)
+		}
+
+		_, err := fmt.Fprint(w, b.String())
+		if err == nil {
+			flusher.Flush()
+		}
+
+		if err != nil || stopping {
+			lock.RLock()
+			return
+		}
+
+		select {
+		case <-sub.c:
+		case <-r.Context().Done():
+			lock.RLock()
+			return
+		case <-shutdown:
+			stopping = true
+		}
+
+		lock.RLock()
+	}
+}
@@ -0,0 +1,200 @@
+package chat
+
+import (
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The pages, as html/template templates. Operators may replace any of them
+// with a file of the same name in the -templates directory.
+const (
+	welcomePage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport"
+		content="width=device-width, initial-scale=1, shrink-to-fit=no">
+	<meta name="author" content="Esote">
+	<meta name="description" content="Room-based chat server">
+	<title>Room-based chat server</title>
+</head>
+<body>{{.Banner}}
+	<p>welcome, join existing rooms:</p>
+	{{- range .Rooms}}
+	<p><a href="{{$.Prefix}}/{{.}}">{{.}} &gt;</a></p>
+	{{- end}}
+	<form action="{{.Prefix}}/" method="get" autocomplete="off">
+		<label>or make a room: </label>
+		<input type="text" name="name" required placeholder="name_here"
+			maxlength="{{.MaxNameLen}}" pattern="{{.NamePattern}}"
+			title="letters">
+		<input type="submit" value="make room">
+	</form>
+	<p>from a terminal: <code>curl host/name</code> to read,
+		<code>curl -d msg=hello host/name</code> to post</p>
+	<p>chat is not moderated, and no connection logs are kept</p>
+	<p><a href="{{.Prefix}}/about">limits and server stats</a></p>
+	<p>Author: <a href="https://github.com/esote"
+		target="_blank">Esote</a>.
+
+		<a href="https://github.com/esote/chat"
+		target="_blank">Source code</a>
+		(<a href="{{.Prefix}}/version">{{.Version}}</a>).</p>
+</body>
+</html>`
+
+	roomPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport"
+		content="width=device-width, initial-scale=1, shrink-to-fit=no">
+	<title>Room: {{.Name}}</title>
+</head>
+<body>
+	<p>room: {{.Name}}</p>
+	<p><a href="{{.Prefix}}/">&lt; back</a>
+		<a href="{{.Prefix}}/{{.Name}}/stats">stats</a>
+		<a href="{{.Prefix}}/{{.Name}}/transcript">download
+			transcript</a>
+{{- if .Archive}}
+		<a href="{{.Prefix}}/{{.Name}}/archive">past days</a>
+{{- end}}</p>
+	{{- .Controls}}
+	<form action="{{.Name}}" method="post" autocomplete="off">
+		<input type="text" name="msg" required autofocus
+			maxlength="{{.MaxMsgLen}}" dir="auto">
+		<input type="text" name="in" size="6" maxlength="8"
+			placeholder="later?" title="post after a delay, e.g. 90m">
+		<input type="submit" value="msg">
+	</form>
+	<p id="status" hidden></p>
+	<p>chat history (time in UTC):</p><div id="chat">{{.Chat}}</div>
+{{- if .NoJS}}
+	<p>refresh the page to see new messages</p>
+{{- else}}
+	<noscript>
+		<p>without JS manually refresh to page to see new messages</p>
+	</noscript>
+	<script src="{{.Prefix}}/static/realtime.js"
+		integrity="{{.Integrity}}"></script>
+{{- end}}
+</body>
+</html>`
+
+	errorPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport"
+		content="width=device-width, initial-scale=1, shrink-to-fit=no">
+	<title>{{.Code}} {{.Status}}</title>
+</head>
+<body>
+	<p>{{.Error}}</p>
+	<p><a href="{{.Prefix}}/">&lt; back</a></p>
+</body>
+</html>`
+)
+
+// pages holds the templates, by file name.
+var pages = template.Must(parsePages(""))
+
+type welcomeData struct {
+	Prefix      string
+	Banner      template.HTML
+	Rooms       []string
+	MaxNameLen  int
+	NamePattern string
+	Version     string
+}
+
+type roomData struct {
+	Prefix    string
+	Name      string
+	Controls  template.HTML
+	MaxMsgLen int
+	Chat      template.HTML
+	NoJS      bool
+	Archive   bool
+
+	// Integrity is the SRI hash of realtime.js.
+	Integrity string
+}
+
+type errorData struct {
+	Prefix string
+	Code   int
+	Status string
+	Error  string
+}
+
+// parsePages parses the default templates, or their replacements in dir if
+// not empty.
+func parsePages(dir string) (*template.Template, error) {
+	t := template.New("")
+
+	for name, text := range map[string]string{
+		"welcome.html": welcomePage,
+		"room.html":    roomPage,
+		"error.html":   errorPage,
+	} {
+		if dir != "" {
+			b, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err == nil {
+				text = string(b)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+
+		if _, err := t.New(name).Parse(text); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// pageError replies with the error page to browsers, and as http.Error does
+// to other clients.
+func pageError(w http.ResponseWriter, r *http.Request, text string,
+	code int) {
+	if wantsPlain(r) || !strings.Contains(r.Header.Get("Accept"),
+		"text/html") {
+		http.Error(w, text, code)
+		return
+	}
+
+	setCSP(w, "default-src 'none';")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	renderPage(w, "error.html", errorData{
+		Prefix: prefix,
+		Code:   code,
+		Status: http.StatusText(code),
+		Error:  text,
+	})
+}
+
+// renderPage writes the page from the template of that name. Pages are
+// rendered in full first, so a failing template sends an error rather than
+// part of a page.
+func renderPage(w http.ResponseWriter, name string, data interface{}) {
+	b := getBuf()
+	defer putBuf(b)
+
+	if err := pages.ExecuteTemplate(b, name, data); err != nil {
+		log.Printf("template %s: %v", name, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Write(b.Bytes())
+}
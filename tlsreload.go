@@ -0,0 +1,121 @@
+package chat
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certCheck is how often the certificate files are checked for renewal.
+const certCheck = time.Minute
+
+// certReloader serves the certificate in certFile and keyFile, reloading it
+// on SIGHUP or when either file changes, so renewals need no restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	mod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// modTime returns the latest modification time of the two files.
+func (cr *certReloader) modTime() (time.Time, error) {
+	var mod time.Time
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return mod, err
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	return mod, nil
+}
+
+func (cr *certReloader) load() error {
+	mod, err := cr.modTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	cr.cert, cr.mod = &cert, mod
+	cr.mu.Unlock()
+
+	return nil
+}
+
+// watch reloads the certificate until the process exits. A failed reload
+// keeps the previous certificate.
+func (cr *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(certCheck)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			mod, err := cr.modTime()
+			cr.mu.Lock()
+			same := err == nil && !mod.After(cr.mod)
+			cr.mu.Unlock()
+			if same {
+				continue
+			}
+		}
+
+		if err := cr.load(); err != nil {
+			log.Printf("tls: reload: %v", err)
+		} else {
+			log.Println("tls: certificate reloaded")
+		}
+	}
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.cert, nil
+}
+
+// tlsConfig returns the settings of the TLS listeners, serving certificates
+// from getCert: TLS 1.2 or later and, below 1.3, only forward-secret AEAD
+// cipher suites.
+func tlsConfig(getCert func(*tls.ClientHelloInfo) (*tls.Certificate,
+	error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCert,
+		MinVersion:     tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"errors"
+	"regexp"
+	"time"
+)
+
+var (
+	// trustAfter is how long after their first msg in a room a poster is
+	// no longer a newcomer there. Zero disables newcomer limits.
+	trustAfter = 10 * time.Minute
+
+	// newcomerLimit paces newcomers to one msg every 15 seconds per room.
+	newcomerLimit = newLimiter(1.0/15, 2)
+
+	links = regexp.MustCompile(`(?i)\b(https?://|www\.)|\.(com|net|org)\b`)
+
+	errSlowDown = errors.New("slow down, you are new here")
+	errNoLinks  = errors.New("links are not allowed from new posters")
+)
+
+// newcomer reports whether id has yet to earn trust in the room. Only msgs
+// that were accepted start the clock, so denied posters stay newcomers.
+func newcomer(name, id string) bool {
+	if trustAfter == 0 {
+		return false
+	}
+
+	rm, ok := rlockRoom(name)
+	if !ok {
+		return true
+	}
+	first, ok := rm.stats.posters[id]
+	rm.unlock()
+
+	return !ok || time.Since(first) < trustAfter
+}
+
+// checkTrust applies the stricter newcomer limits to the cleaned str. The
+// global lock must not be held.
+func checkTrust(name, str, id string) error {
+	if str == "" || !newcomer(name, id) {
+		return nil
+	}
+
+	if links.MatchString(str) {
+		return errNoLinks
+	}
+
+	if ok, _ := newcomerLimit.allow(name + "/" + id); !ok {
+		return errSlowDown
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/esote/chat/client"
+	"golang.org/x/term"
+)
+
+// clientMain runs "chat client url room": a terminal client showing the
+// room's msgs as they arrive above an input line.
+func clientMain(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: chat client url room")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c := client.New(fs.Arg(0))
+	room := fs.Arg(1)
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return errors.New("stdin is not a terminal")
+	}
+
+	old, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, old)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "> ")
+	if w, h, err := term.GetSize(fd); err == nil {
+		_ = t.SetSize(w, h)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fmt.Fprintf(t, "%s in %s, ctrl-d to quit\n", fs.Arg(0), room)
+
+	go clientFollow(ctx, c, room, t)
+
+	for {
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if line == "" {
+			continue
+		}
+
+		if _, err := c.Post(ctx, room, line); err != nil {
+			fmt.Fprintf(t, "error: %v\n", err)
+		}
+	}
+}
+
+// clientFollow writes the msgs of the room to w as they arrive, resuming
+// after dropped connections until the room expires or ctx is done.
+func clientFollow(ctx context.Context, c *client.Client, room string,
+	w io.Writer) {
+	var seen uint64
+	var cerr *client.Error
+
+	for {
+		err := c.Subscribe(ctx, room, seen, func(m client.Message) {
+			fmt.Fprintf(w, "%s: %s\n",
+				m.Time.Local().Format("15:04"), m.Text)
+			seen = m.Seq
+		})
+
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == client.ErrExpired:
+			fmt.Fprintln(w, "room expired")
+			return
+		case errors.As(err, &cerr) && cerr.Code == http.StatusNotFound:
+			// Not made yet, or until the first post.
+		case err != client.ErrClosed:
+			fmt.Fprintf(w, "error: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
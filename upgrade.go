@@ -0,0 +1,124 @@
+//go:build !windows
+
+package chat
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// upgradeWait bounds how long the new process may take to start serving
+// before the upgrade is abandoned.
+const upgradeWait = time.Minute
+
+// upgradeOnSignal starts exe anew on each SIGUSR2, handing it the sockets.
+// Posts are refused and save is called first, so the new process starts
+// from the rooms of this one, missing none. Once the new process serves,
+// this one shuts down as if interrupted; until then this one keeps serving,
+// and if it fails, takes posts again.
+func upgradeOnSignal(exe string, save func() error) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+
+	for range usr2 {
+		log.Println("upgrade: starting", exe)
+		if err := upgrade(exe, save); err != nil {
+			log.Printf("upgrade: %v", err)
+
+			lock.Lock()
+			upgrading = false
+			lock.Unlock()
+			continue
+		}
+		log.Println("upgrade: new process serving, shutting down")
+
+		// The new process holds the unix sockets now.
+		for _, s := range sockets {
+			if ul, ok := s.conn.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+		}
+
+		atomic.StoreUint32(&upgraded, 1)
+		if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+}
+
+func upgrade(exe string, save func() error) error {
+	// Posts already storing finish first, so they are saved.
+	lock.Lock()
+	upgrading = true
+	all := make([]string, 0, len(rooms))
+	for name := range rooms {
+		all = append(all, name)
+	}
+	waitRooms(all...)
+	lock.Unlock()
+
+	if err := save(); err != nil {
+		return err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, s := range sockets {
+		f, err := s.conn.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, s.addr)
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files[:len(files):len(files)], w)
+	cmd.Env = append(os.Environ(),
+		upgradeEnv+"="+strings.Join(names, ","),
+		readyEnv+"="+strconv.Itoa(listenFDsStart+len(files)))
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	go func() {
+		_ = cmd.Wait()
+	}()
+
+	// The pipe reaches EOF without the byte if the new process exits.
+	if err = r.SetReadDeadline(time.Now().Add(upgradeWait)); err != nil {
+		_ = cmd.Process.Kill()
+		return err
+	}
+	if _, err = r.Read(make([]byte, 1)); err != nil {
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("new process did not serve: %v", err)
+	}
+
+	return nil
+}
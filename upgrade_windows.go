@@ -0,0 +1,8 @@
+package chat
+
+import "log"
+
+// upgradeOnSignal is unsupported, as Windows has no SIGUSR2.
+func upgradeOnSignal(exe string, save func() error) {
+	log.Println("upgrade: unsupported on Windows")
+}
@@ -0,0 +1,93 @@
+package chat
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Set at build time with e.g.
+//
+//	go build -ldflags "-X github.com/esote/chat.version=v1.2.0
+//		-X github.com/esote/chat.commit=abc123
+//		-X github.com/esote/chat.buildTime=2024-05-17T12:00:00Z" ./cmd/chat
+//
+// Anything left empty is filled from the build info embedded by the Go
+// toolchain, where available.
+var (
+	version   string
+	commit    string
+	buildTime string
+)
+
+func init() {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+
+	if version == "" && bi.Main.Version != "" &&
+		bi.Main.Version != "(devel)" {
+		version = bi.Main.Version
+	}
+
+	modified := false
+
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if commit == "" {
+				commit = s.Value
+			}
+		case "vcs.time":
+			if buildTime == "" {
+				buildTime = s.Value
+			}
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+
+	if modified && commit != "" && !strings.HasSuffix(commit, "-dirty") {
+		commit += "-dirty"
+	}
+}
+
+// versionString describes the running build in one line.
+func versionString() string {
+	v := version
+	if v == "" {
+		v = "devel"
+	}
+
+	if commit != "" {
+		v += " " + commit
+	}
+
+	if buildTime != "" {
+		v += " " + buildTime
+	}
+
+	return v + " " + runtime.Version()
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "bad http verb", http.StatusMethodNotAllowed)
+		return
+	}
+
+	securityHeaders(w)
+	setCSP(w, "default-src 'none';")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	v := version
+	if v == "" {
+		v = "devel"
+	}
+
+	fmt.Fprintf(w, "version: %s\ncommit: %s\nbuilt: %s\ngo: %s\n",
+		v, commit, buildTime, runtime.Version())
+}
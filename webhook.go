@@ -0,0 +1,182 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookQueue is how many msgs may wait for each hook before new ones
+	// are dropped, so a slow hook cannot hold up posting.
+	webhookQueue = 256
+
+	webhookTimeout = 5 * time.Second
+
+	// webhookTries is how many times a delivery is attempted.
+	webhookTries = 3
+)
+
+// webhook is an operator's URL each new msg is POSTed to, or only msgs in
+// room if set.
+type webhook struct {
+	url  string
+	room string
+	msgs chan []byte
+}
+
+var (
+	webhooks []*webhook
+
+	// webhookSecret, if set, signs each payload with HMAC-SHA256, sent as
+	// X-Chat-Signature: sha256=<hex>.
+	webhookSecret []byte
+
+	webhookClient = &http.Client{}
+)
+
+// webhookMsg is the JSON POSTed to webhooks. Text is the plain text.
+type webhookMsg struct {
+	Room string    `json:"room"`
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+	ID   string    `json:"id"`
+}
+
+// parseWebhooks parses a comma-separated list of URLs, each optionally
+// prefixed by room= to only receive msgs in that room.
+func parseWebhooks(s string) ([]*webhook, error) {
+	var hooks []*webhook
+
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+
+		h := &webhook{url: f}
+		if i := strings.IndexByte(f, '='); i > 0 &&
+			validName.MatchString(f[:i]) {
+			h.room, h.url = f[:i], f[i+1:]
+		}
+
+		u, err := url.Parse(h.url)
+		if err != nil {
+			return nil, err
+		} else if u.Scheme != "https" && u.Scheme != "http" ||
+			u.Host == "" {
+			return nil, fmt.Errorf("webhook: bad URL %q", h.url)
+		}
+
+		h.msgs = make(chan []byte, webhookQueue)
+		hooks = append(hooks, h)
+	}
+
+	return hooks, nil
+}
+
+// startWebhooks starts delivering to each hook, in order.
+func startWebhooks() {
+	for _, h := range webhooks {
+		go h.deliver()
+	}
+}
+
+func init() {
+	listen(func(e event) {
+		if e, ok := e.(msgPosted); ok {
+			notifyWebhooks(e.room, e.id, e.msg)
+		}
+	})
+}
+
+// notifyWebhooks queues a new msg for the hooks wanting it. It never blocks.
+func notifyWebhooks(name, id string, m Message) {
+	if len(webhooks) == 0 || raftFollower() {
+		return
+	}
+
+	b, err := json.Marshal(webhookMsg{
+		Room: name,
+		Seq:  m.Seq,
+		Time: m.Time,
+		Text: html.UnescapeString(m.HTML),
+		ID:   id,
+	})
+	if err != nil {
+		log.Printf("webhook: %v", err)
+		return
+	}
+
+	for _, h := range webhooks {
+		if h.room != "" && h.room != name {
+			continue
+		}
+
+		select {
+		case h.msgs <- b:
+		default:
+			log.Printf("webhook: %s: queue full, dropping msg",
+				h.url)
+		}
+	}
+}
+
+func (h *webhook) deliver() {
+	for b := range h.msgs {
+		delay := time.Second
+		for i := 1; ; i++ {
+			err := h.post(b)
+			if err == nil {
+				break
+			} else if i == webhookTries {
+				log.Printf("webhook: giving up on %s: %v", h.url,
+					err)
+				break
+			}
+			time.Sleep(delay)
+			delay *= 4
+		}
+	}
+}
+
+func (h *webhook) post(b []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url,
+		bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if webhookSecret != nil {
+		mac := hmac.New(sha256.New, webhookSecret)
+		mac.Write(b)
+		req.Header.Set("X-Chat-Signature",
+			"sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
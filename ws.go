@@ -0,0 +1,117 @@
+package chat
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var errCrossOrigin = errors.New("cross-origin websocket")
+
+// wsHandler serves /ws/name, pushing the rendered chat of the room to the
+// client whenever it changes. realtime.js falls back to polling without it.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/ws/")
+	if name == "" || len(name) > maxNameLen || !validName.MatchString(name) {
+		http.Error(w, "bad name", http.StatusBadRequest)
+		return
+	}
+
+	if !limit(readLimit, w, r) {
+		return
+	}
+
+	websocket.Server{
+		Handshake: sameOrigin,
+		Handler: func(ws *websocket.Conn) {
+			wsChat(name, ws)
+		},
+	}.ServeHTTP(w, r)
+}
+
+// sameOrigin refuses handshakes from other sites' pages, which browsers would
+// otherwise allow.
+func sameOrigin(_ *websocket.Config, r *http.Request) error {
+	u, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || u.Host != r.Host {
+		return errCrossOrigin
+	}
+	return nil
+}
+
+func wsChat(name string, ws *websocket.Conn) {
+	lock.RLock()
+	name, _ = resolve(name)
+	_, ok := rooms[name]
+	lock.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	streams.Add(1)
+	defer streams.Done()
+
+	sub := watch(name)
+	defer sub.stop()
+
+	// Clients send nothing, but reading notices when they go away.
+	done := make(chan struct{})
+	go func() {
+		var s string
+		for websocket.Message.Receive(ws, &s) == nil {
+		}
+		close(done)
+	}()
+
+	var b strings.Builder
+	stopping := false
+
+	for {
+		lock.RLock()
+		rm, ok := rooms[name]
+		if !ok {
+			to, moved := resolve(name)
+			lock.RUnlock()
+			if !moved {
+				return
+			}
+			name = to
+			sub.follow(to)
+			continue
+		}
+		b.Reset()
+		if stopping && noticeShutdown() {
+			printNotice(&b, shutdownNotice)
+		}
+		rm.mu.Lock()
+		printChat(rm, &b)
+		rm.unlock()
+
+		if err := ws.SetWriteDeadline(time.Now().Add(
+			10 * time.Second)); err != nil {
+			return
+		}
+		if websocket.Message.Send(ws, b.String()) != nil {
+			return
+		}
+
+		// As for line sessions, one last pass delivers msgs posted
+		// before shutdown, along with the notice.
+		if stopping {
+			return
+		}
+
+		select {
+		case <-sub.c:
+		case <-done:
+			return
+		case <-shutdown:
+			stopping = true
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package chat
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// xmppRetry is how long to wait before reconnecting to the XMPP server.
+const xmppRetry = 5 * time.Second
+
+var (
+	// xmppAddr is the XMPP server's component port (XEP-0114), and
+	// xmppDomain the component's domain: room abc is abc@xmppDomain.
+	xmppAddr   string
+	xmppDomain string
+	xmppSecret string
+
+	errXMPPHandshake = errors.New("xmpp: handshake refused")
+	errNotJoined     = errors.New("not in the room")
+)
+
+// xmppStanza is the part of a stanza the gateway looks at.
+type xmppStanza struct {
+	XMLName xml.Name
+	From    string    `xml:"from,attr"`
+	To      string    `xml:"to,attr"`
+	Type    string    `xml:"type,attr"`
+	ID      string    `xml:"id,attr"`
+	Body    string    `xml:"body"`
+	Disco   *struct{} `xml:"http://jabber.org/protocol/disco#info query"`
+}
+
+// xmppConn is a component session. Occupants map each room to the full JIDs
+// in it and their nicks; a goroutine per occupied room relays its msgs.
+type xmppConn struct {
+	c    net.Conn
+	done chan struct{}
+
+	mu sync.Mutex // serializes writes
+
+	// occupants is guarded by the global lock.
+	occupants map[string]map[string]string
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func (xc *xmppConn) send(format string, a ...interface{}) error {
+	for i, v := range a {
+		if s, ok := v.(string); ok {
+			a[i] = xmlEscape(s)
+		}
+	}
+
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+
+	if err := xc.c.SetWriteDeadline(time.Now().Add(
+		10 * time.Second)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(xc.c, format, a...)
+	return err
+}
+
+// xmpp keeps a component session with the XMPP server open, exposing each
+// room as a multi-user chat.
+func xmpp() {
+	for {
+		if err := xmppSession(); err != nil {
+			log.Printf("xmpp: %v", err)
+		}
+
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(xmppRetry):
+		}
+	}
+}
+
+func xmppSession() error {
+	c, err := net.DialTimeout("tcp", xmppAddr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	xc := &xmppConn{
+		c:         c,
+		done:      make(chan struct{}),
+		occupants: make(map[string]map[string]string),
+	}
+	defer close(xc.done)
+
+	if err := xc.send("<stream:stream xmlns='jabber:component:accept' "+
+		"xmlns:stream='http://etherx.jabber.org/streams' to='%s'>",
+		xmppDomain); err != nil {
+		return err
+	}
+
+	dec := xml.NewDecoder(c)
+
+	id, err := xmppStreamID(dec)
+	if err != nil {
+		return err
+	}
+
+	sum := sha1.Sum([]byte(id + xmppSecret))
+	if err := xc.send("<handshake>%s</handshake>",
+		hex.EncodeToString(sum[:])); err != nil {
+		return err
+	}
+
+	for {
+		var st xmppStanza
+		if err := xmppNext(dec, &st); err != nil {
+			return err
+		}
+
+		switch st.XMLName.Local {
+		case "handshake":
+			log.Printf("xmpp: connected as %s", xmppDomain)
+		case "error":
+			return errXMPPHandshake
+		case "presence":
+			err = xc.presence(st)
+		case "message":
+			err = xc.message(st)
+		case "iq":
+			err = xc.iq(st)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// xmppStreamID reads the server's stream header.
+func xmppStreamID(dec *xml.Decoder) (string, error) {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", err
+		}
+		if se, ok := tok.(xml.StartElement); ok &&
+			se.Name.Local == "stream" {
+			for _, a := range se.Attr {
+				if a.Name.Local == "id" {
+					return a.Value, nil
+				}
+			}
+			return "", errXMPPHandshake
+		}
+	}
+}
+
+// xmppNext decodes the next top-level stanza into st.
+func xmppNext(dec *xml.Decoder, st *xmppStanza) error {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			return dec.DecodeElement(st, &t)
+		case xml.EndElement:
+			if t.Name.Local == "stream" {
+				return io.EOF
+			}
+		}
+	}
+}
+
+// xmppRoom splits a JID to the component into its room name and resource.
+func xmppRoom(jid string) (string, string) {
+	local, rest, ok := strings.Cut(jid, "@")
+	if !ok {
+		return "", ""
+	}
+	domain, resource, _ := strings.Cut(rest, "/")
+	if !strings.EqualFold(domain, xmppDomain) {
+		return "", ""
+	}
+
+	name := strings.ToLower(local)
+	if name == "" || len(name) > maxNameLen || !validName.MatchString(name) {
+		return "", ""
+	}
+	return name, resource
+}
+
+func xmppBare(jid string) string {
+	bare, _, _ := strings.Cut(jid, "/")
+	return bare
+}
+
+func (xc *xmppConn) presence(st xmppStanza) error {
+	name, nick := xmppRoom(st.To)
+	if name == "" || nick == "" {
+		return xc.send("<presence from='%s' to='%s' type='error'>"+
+			"<error type='modify'><jid-malformed "+
+			"xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>"+
+			"</error></presence>", st.To, st.From)
+	}
+	room := name + "@" + xmppDomain
+
+	if st.Type == "unavailable" {
+		lock.Lock()
+		delete(xc.occupants[name], st.From)
+		lock.Unlock()
+
+		return xc.send("<presence from='%s/%s' to='%s' "+
+			"type='unavailable'><x xmlns='http://jabber.org/"+
+			"protocol/muc#user'><item affiliation='none' "+
+			"role='none'/><status code='110'/></x></presence>",
+			room, nick, st.From)
+	}
+
+	lock.Lock()
+	pruneRooms()
+	name, _ = resolve(name)
+	err := createRoom(name)
+	var history []msg
+	joined := false
+	if err == nil {
+		occ, ok := xc.occupants[name]
+		if !ok {
+			occ = make(map[string]string)
+			xc.occupants[name] = occ
+		}
+		_, joined = occ[st.From]
+		occ[st.From] = nick
+		history = append(history, rooms[name].msgs.slice()...)
+
+		if !ok {
+			streams.Add(1)
+			go xc.follow(name, rooms[name].seq)
+		}
+	}
+	lock.Unlock()
+
+	if err != nil {
+		return xc.send("<presence from='%s/%s' to='%s' type='error'>"+
+			"<error type='cancel'><not-allowed "+
+			"xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>"+
+			"<text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'>"+
+			"%s</text></error></presence>", room, nick, st.From,
+			err.Error())
+	}
+
+	if err := xc.send("<presence from='%s/%s' to='%s'><x "+
+		"xmlns='http://jabber.org/protocol/muc#user'><item "+
+		"affiliation='none' role='participant'/><status "+
+		"code='110'/></x></presence>", room, nick, st.From); err != nil {
+		return err
+	}
+
+	// Presence updates from occupants need no history.
+	if joined {
+		return nil
+	}
+
+	for i := len(history) - 1; i >= 0; i-- {
+		m := history[i]
+		if err := xc.send("<message type='groupchat' from='%s/anon' "+
+			"to='%s'><body>%s</body><delay xmlns='urn:xmpp:delay' "+
+			"stamp='%s'/></message>", room, st.From,
+			html.UnescapeString(m.s),
+			m.at.Format(time.RFC3339)); err != nil {
+			return err
+		}
+	}
+
+	// The subject marks the end of the history.
+	return xc.send("<message type='groupchat' from='%s' to='%s'>"+
+		"<subject>%s</subject></message>", room, st.From, name)
+}
+
+func (xc *xmppConn) message(st xmppStanza) error {
+	name, _ := xmppRoom(st.To)
+	if name == "" || st.Type != "groupchat" || st.Body == "" {
+		return nil
+	}
+
+	lock.Lock()
+	name, _ = resolve(name)
+	_, joined := xc.occupants[name][st.From]
+	lock.Unlock()
+
+	err := errNotJoined
+	if joined {
+		_, err = addMsg(name, st.Body,
+			clientID("xmpp:"+xmppBare(st.From)))
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	return xc.send("<message type='error' from='%s' to='%s' id='%s'>"+
+		"<error type='modify'><not-acceptable "+
+		"xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/><text "+
+		"xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'>%s</text>"+
+		"</error></message>", st.To, st.From, st.ID, err.Error())
+}
+
+func (xc *xmppConn) iq(st xmppStanza) error {
+	if st.Type != "get" && st.Type != "set" {
+		return nil
+	}
+
+	if st.Type == "get" && st.Disco != nil {
+		if name, _ := xmppRoom(st.To); name != "" {
+			return xc.send("<iq type='result' from='%s' to='%s' "+
+				"id='%s'><query xmlns='http://jabber.org/"+
+				"protocol/disco#info'><identity "+
+				"category='conference' type='text' name='%s'/>"+
+				"<feature var='http://jabber.org/protocol/muc'/>"+
+				"<feature var='muc_public'/><feature "+
+				"var='muc_open'/><feature var='muc_semianonymous'/>"+
+				"</query></iq>", st.To, st.From, st.ID, name)
+		}
+		return xc.send("<iq type='result' from='%s' to='%s' id='%s'>"+
+			"<query xmlns='http://jabber.org/protocol/disco#info'>"+
+			"<identity category='conference' type='text' "+
+			"name='chat'/><feature var='http://jabber.org/"+
+			"protocol/muc'/></query></iq>", st.To, st.From, st.ID)
+	}
+
+	return xc.send("<iq type='error' from='%s' to='%s' id='%s'><error "+
+		"type='cancel'><service-unavailable xmlns='urn:ietf:params:"+
+		"xml:ns:xmpp-stanzas'/></error></iq>", st.To, st.From, st.ID)
+}
+
+// follow relays new msgs in the room to its occupants, until it has none or
+// the session ends. As for line sessions, one last pass delivers msgs posted
+// before shutdown, then the notice, from the room itself.
+func (xc *xmppConn) follow(name string, seen uint64) {
+	defer streams.Done()
+
+	sub := watch(name)
+	defer sub.stop()
+
+	stopping := false
+
+	for {
+		var bodies []string
+
+		lock.Lock()
+		occ := xc.occupants[name]
+		rm, ok := rooms[name]
+		if !ok || len(occ) == 0 {
+			delete(xc.occupants, name)
+			lock.Unlock()
+			return
+		}
+		for i := rm.msgs.Len() - 1; i >= 0; i-- {
+			if m := rm.msgs.At(i); m.seq > seen {
+				bodies = append(bodies, html.UnescapeString(m.s))
+			}
+		}
+		seen = rm.seq
+		jids := make([]string, 0, len(occ))
+		for jid := range occ {
+			jids = append(jids, jid)
+		}
+		lock.Unlock()
+
+		room := name + "@" + xmppDomain
+		for _, body := range bodies {
+			for _, jid := range jids {
+				if xc.send("<message type='groupchat' "+
+					"from='%s/anon' to='%s'><body>%s</body>"+
+					"</message>", room, jid, body) != nil {
+					return
+				}
+			}
+		}
+
+		if stopping {
+			if !noticeShutdown() {
+				return
+			}
+			for _, jid := range jids {
+				_ = xc.send("<message type='groupchat' "+
+					"from='%s' to='%s'><body>%s</body>"+
+					"</message>", room, jid, shutdownNotice)
+			}
+			return
+		}
+
+		select {
+		case <-sub.c:
+		case <-xc.done:
+			return
+		case <-shutdown:
+			stopping = true
+		}
+	}
+}